@@ -2,4 +2,4 @@ module lab5
 
 go 1.24.5
 
-require golang.org/x/sys v0.37.0 // indirect
+require golang.org/x/sys v0.37.0
@@ -0,0 +1,149 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	LOG_FORMAT_JSON   = "json"
+	LOG_FORMAT_COMMON = "common"
+)
+
+// accessLog writes one line per finished session. Lines are written with a
+// single write on an O_APPEND file, so they are not interleaved.
+type accessLog struct {
+	file   *os.File
+	format string
+}
+
+type accessEntry struct {
+	Time      string  `json:"time"`
+	Client    string  `json:"client"`
+	User      string  `json:"user,omitempty"`
+	Command   string  `json:"command"`
+	Host      string  `json:"host,omitempty"`
+	Port      uint16  `json:"port,omitempty"`
+	Resolved  string  `json:"resolved,omitempty"`
+	Reply     byte    `json:"reply"`
+	BytesUp   uint64  `json:"bytes_up"`
+	BytesDown uint64  `json:"bytes_down"`
+	Duration  float64 `json:"duration"`
+	Reason    string  `json:"reason"`
+}
+
+func openAccessLog(path, format string) (*accessLog, error) {
+	if format != LOG_FORMAT_JSON && format != LOG_FORMAT_COMMON {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLog{file: f, format: format}, nil
+}
+
+func (s *Server) OpenAccessLog(path, format string) error {
+	l, err := openAccessLog(path, format)
+	if err != nil {
+		return err
+	}
+	s.accessLog = l
+	return nil
+}
+
+func commandName(cmd byte) string {
+	switch cmd {
+	case CMD_CONNECT:
+		return "CONNECT"
+	case CMD_BIND:
+		return "BIND"
+	case CMD_UDP_ASSOCIATE:
+		return "UDP_ASSOCIATE"
+	}
+	return "-"
+}
+
+func newAccessEntry(conn *Conn, now time.Time) accessEntry {
+	e := accessEntry{
+		Time:      now.Format(time.RFC3339),
+		User:      conn.user,
+		Command:   commandName(conn.cmd),
+		Port:      conn.port,
+		Reply:     conn.rep,
+		BytesUp:   conn.up.bytes,
+		BytesDown: conn.down.bytes,
+		Duration:  now.Sub(conn.started).Seconds(),
+		Reason:    conn.reason,
+	}
+	if ip, port := sockaddrToIP(conn.caddr); ip != nil {
+		e.Client = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	}
+	e.Host = conn.domain
+	if e.Host == "" {
+		e.Host = conn.host
+	}
+	if conn.raddr != nil {
+		e.Resolved = conn.raddr.String()
+	}
+	return e
+}
+
+// common renders e like the Common Log Format, with the resolved address,
+// duration and close reason appended.
+func (e accessEntry) common(now time.Time) string {
+	dash := func(v string) string {
+		if v == "" {
+			return "-"
+		}
+		return v
+	}
+	dst := "-"
+	if e.Host != "" {
+		dst = net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port)))
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s\" %d %d %d %s %.3f %q\n",
+		dash(e.Client), dash(e.User), now.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Command, dst, e.Reply, e.BytesUp, e.BytesDown, dash(e.Resolved), e.Duration, e.Reason)
+}
+
+func (s *Server) logAccess(conn *Conn) {
+	if s.accessLog == nil {
+		return
+	}
+	now := time.Now()
+	e := newAccessEntry(conn, now)
+	var line []byte
+	if s.accessLog.format == LOG_FORMAT_JSON {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(e.common(now))
+	}
+	if _, err := s.accessLog.file.Write(line); err != nil {
+		fmt.Printf("Failed write access log: %v\n", err)
+	}
+}
+
+// closeWith records why the session ends and closes it. The first reason
+// wins, later ones come from tearing down what is left.
+func (s *Server) closeWith(conn *Conn, reason string) {
+	if conn == nil {
+		return
+	}
+	if conn.reason == "" {
+		conn.reason = reason
+	}
+	s.closeConn(conn)
+}
+
+func (l *accessLog) Close() error {
+	return l.file.Close()
+}
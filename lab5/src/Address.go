@@ -0,0 +1,151 @@
+package src
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ATYP_IPV4   = 0x01
+	ATYP_DOMAIN = 0x03
+	ATYP_IPV6   = 0x04
+
+	CMD_CONNECT       = 0x01
+	CMD_BIND          = 0x02
+	CMD_UDP_ASSOCIATE = 0x03
+)
+
+// errIncomplete means the buffer holds only the beginning of a message.
+var errIncomplete = errors.New("incomplete message")
+
+// maxHandshakeLen bounds a single handshake message: a request with a
+// 255 byte domain is the longest one.
+const maxHandshakeLen = 1024
+
+type socksAddr struct {
+	ip     net.IP
+	domain string
+	port   uint16
+}
+
+func (a socksAddr) host() string {
+	if a.domain != "" {
+		return a.domain
+	}
+	return a.ip.String()
+}
+
+// parseAddress decodes ATYP, DST.ADDR and DST.PORT starting at data[0] and
+// returns the number of bytes consumed.
+func parseAddress(data []byte) (socksAddr, int, error) {
+	var addr socksAddr
+	if len(data) < 1 {
+		return addr, 0, errIncomplete
+	}
+	var n int
+	switch data[0] {
+	case ATYP_IPV4:
+		if len(data) < 1+net.IPv4len+PORT_LEN {
+			return addr, 0, errIncomplete
+		}
+		addr.ip = net.IP(append([]byte(nil), data[1:1+net.IPv4len]...))
+		n = 1 + net.IPv4len
+	case ATYP_DOMAIN:
+		if len(data) < 2 {
+			return addr, 0, errIncomplete
+		}
+		domainLen := int(data[1])
+		if len(data) < 2+domainLen+PORT_LEN {
+			return addr, 0, errIncomplete
+		}
+		addr.domain = string(data[2 : 2+domainLen])
+		n = 2 + domainLen
+	case ATYP_IPV6:
+		if len(data) < 1+net.IPv6len+PORT_LEN {
+			return addr, 0, errIncomplete
+		}
+		addr.ip = net.IP(append([]byte(nil), data[1:1+net.IPv6len]...))
+		n = 1 + net.IPv6len
+	default:
+		return addr, 0, errors.New("unsupported address type")
+	}
+	addr.port = binary.BigEndian.Uint16(data[n : n+PORT_LEN])
+	return addr, n + PORT_LEN, nil
+}
+
+// writeAddress encodes ATYP, BND.ADDR and BND.PORT. A nil ip without a
+// domain is written as 0.0.0.0.
+func writeAddress(buf *bytes.Buffer, ip net.IP, port uint16, domain string) {
+	if domain != "" {
+		buf.WriteByte(ATYP_DOMAIN)
+		buf.WriteByte(byte(len(domain)))
+		buf.WriteString(domain)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf.WriteByte(ATYP_IPV4)
+		buf.Write(ip4)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		buf.WriteByte(ATYP_IPV6)
+		buf.Write(ip16)
+	} else {
+		buf.WriteByte(ATYP_IPV4)
+		buf.Write([]byte{0, 0, 0, 0})
+	}
+	binary.Write(buf, binary.BigEndian, port)
+}
+
+func sockaddrToIP(sa unix.Sockaddr) (net.IP, uint16) {
+	switch a := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(append([]byte(nil), a.Addr[:]...)), uint16(a.Port)
+	case *unix.SockaddrInet6:
+		return net.IP(append([]byte(nil), a.Addr[:]...)), uint16(a.Port)
+	}
+	return nil, 0
+}
+
+func socketFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+func ipToSockaddr(ip net.IP, port uint16) (unix.Sockaddr, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		addr := &unix.SockaddrInet4{Port: int(port)}
+		copy(addr.Addr[:], ip4)
+		return addr, nil
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return nil, errors.New("invalid IP address: " + ip.String())
+	}
+	addr := &unix.SockaddrInet6{Port: int(port)}
+	copy(addr.Addr[:], ip16)
+	return addr, nil
+}
+
+// ipToSockaddrFamily is ipToSockaddr for a socket of the given family: an
+// IPv4 address is mapped into ::ffff:0:0/96 for AF_INET6 sockets.
+func ipToSockaddrFamily(family int, ip net.IP, port uint16) (unix.Sockaddr, error) {
+	if family == unix.AF_INET6 && ip.To4() != nil {
+		addr := &unix.SockaddrInet6{Port: int(port)}
+		copy(addr.Addr[:], ip.To16())
+		return addr, nil
+	}
+	if family == unix.AF_INET && ip.To4() == nil {
+		return nil, errors.New("not an IPv4 address: " + ip.String())
+	}
+	return ipToSockaddr(ip, port)
+}
+
+func sockaddrFamily(sa unix.Sockaddr) int {
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
@@ -0,0 +1,456 @@
+package src
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The admin socket speaks a line protocol. Every command is answered with
+// zero or more lines and a final "OK" or "ERR <message>" line:
+//
+//	list         one line per session by id: state, client, target, bytes
+//	kill <id>    close the session with that id
+//	stats        session and traffic counters
+//	reload       read the config file and the flags again
+//	quit         close the admin connection
+//
+// Session ids are the client fds, which are unique across event loops.
+
+// maxAdminInput bounds what a client may send ahead of its replies.
+const maxAdminInput = 65536
+
+type adminClient struct {
+	fd      int
+	in      []byte
+	out     []byte
+	quit    bool
+	busy    bool // a command is waiting for other loops
+	running bool // inside runAdmin, replies are picked up by processAdmin
+	closed  bool
+}
+
+func (s *Server) SetAdminSocket(path string) {
+	s.adminPath = path
+}
+
+func (s *Server) initAdmin() error {
+	if fi, err := os.Lstat(s.adminPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", s.adminPath); err == nil {
+			c.Close()
+			return fmt.Errorf("admin socket %s is in use", s.adminPath)
+		}
+		// left behind by a previous run
+		os.Remove(s.adminPath)
+	}
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	unix.CloseOnExec(fd)
+	if err = unix.Bind(fd, &unix.SockaddrUnix{Name: s.adminPath}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("admin socket %s: %v", s.adminPath, err)
+	}
+	if err = os.Chmod(s.adminPath, 0600); err == nil {
+		err = unix.Listen(fd, 8)
+	}
+	if err == nil {
+		err = unix.SetNonblock(fd, true)
+	}
+	if err == nil {
+		err = s.selecter.Add(fd, EventRead)
+	}
+	if err != nil {
+		unix.Close(fd)
+		os.Remove(s.adminPath)
+		return err
+	}
+	s.adminFD = fd
+	s.admins = make(map[int]*adminClient)
+	fmt.Printf("Admin socket on %s\n", s.adminPath)
+	return nil
+}
+
+func (s *Server) acceptAdmin() {
+	for {
+		fd, _, err := unix.Accept(s.adminFD)
+		if err != nil {
+			if !isAgain(err) {
+				fmt.Printf("Admin accept failed: %v\n", err)
+			}
+			return
+		}
+		unix.CloseOnExec(fd)
+		if err := unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fd)
+			continue
+		}
+		if err := s.selecter.Add(fd, EventRead); err != nil {
+			unix.Close(fd)
+			continue
+		}
+		s.admins[fd] = &adminClient{fd: fd}
+	}
+}
+
+func (s *Server) handleAdmin(a *adminClient, ev Event) {
+	if ev.Readable {
+		buf := make([]byte, 4096)
+		for {
+			n, err := unix.Read(a.fd, buf)
+			if err != nil {
+				if !isAgain(err) {
+					s.closeAdmin(a)
+					return
+				}
+				break
+			}
+			if n == 0 {
+				s.closeAdmin(a)
+				return
+			}
+			a.in = append(a.in, buf[:n]...)
+		}
+		if len(a.in) > maxAdminInput {
+			s.closeAdmin(a)
+			return
+		}
+		s.processAdmin(a)
+	}
+	s.flushAdmin(a)
+}
+
+// processAdmin runs the complete lines a has sent, one command at a time:
+// a command waiting for other loops holds back the lines after it.
+func (s *Server) processAdmin(a *adminClient) {
+	for !a.busy && !a.quit && !a.closed {
+		i := bytes.IndexByte(a.in, '\n')
+		if i < 0 {
+			return
+		}
+		args := strings.Fields(string(a.in[:i]))
+		a.in = a.in[i+1:]
+		if len(args) == 0 {
+			continue
+		}
+		a.busy, a.running = true, true
+		s.runAdmin(a, args, func(out string, err error) {
+			s.adminReply(a, out, err)
+		})
+		a.running = false
+	}
+}
+
+// adminReply queues the answer to the current command of a and goes on
+// with the next one.
+func (s *Server) adminReply(a *adminClient, out string, err error) {
+	if err != nil {
+		out += fmt.Sprintf("ERR %v\n", err)
+	} else {
+		out += "OK\n"
+	}
+	a.out = append(a.out, out...)
+	a.busy = false
+	if a.closed || a.running {
+		return
+	}
+	s.processAdmin(a)
+	s.flushAdmin(a)
+}
+
+func (s *Server) flushAdmin(a *adminClient) {
+	for len(a.out) > 0 {
+		n, err := unix.Write(a.fd, a.out)
+		if err != nil {
+			if !isAgain(err) {
+				s.closeAdmin(a)
+				return
+			}
+			break
+		}
+		a.out = a.out[n:]
+	}
+	if len(a.out) > 0 {
+		_ = s.selecter.Modify(a.fd, EventRead|EventWrite)
+		return
+	}
+	if a.quit {
+		s.closeAdmin(a)
+		return
+	}
+	_ = s.selecter.Modify(a.fd, EventRead)
+}
+
+func (s *Server) closeAdmin(a *adminClient) {
+	a.closed = true
+	s.selecter.Remove(a.fd)
+	unix.Close(a.fd)
+	delete(s.admins, a.fd)
+}
+
+// runAdmin executes one command and hands its output to reply, right away
+// or, for commands that reach into other loops, once they have answered.
+func (s *Server) runAdmin(a *adminClient, args []string, reply func(out string, err error)) {
+	switch args[0] {
+	case "list":
+		s.eachLoop(func(w *Server) string {
+			return w.listSessions()
+		}, func(loops []string) {
+			reply(sortSessions(loops), nil)
+		})
+	case "kill":
+		if len(args) != 2 {
+			reply("", errors.New("usage: kill <id>"))
+			return
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil || id <= 0 {
+			reply("", fmt.Errorf("invalid session id %q", args[1]))
+			return
+		}
+		s.eachLoop(func(w *Server) string {
+			conn, ok := w.connections[id]
+			if !ok || conn.fd != id {
+				return ""
+			}
+			fmt.Printf("Session %d killed from the admin socket\n", id)
+			w.closeWith(conn, "killed by admin")
+			return "killed"
+		}, func(found []string) {
+			if strings.Join(found, "") == "" {
+				reply("", fmt.Errorf("no session %d", id))
+				return
+			}
+			reply("", nil)
+		})
+	case "stats":
+		var out strings.Builder
+		s.writeStats(&out)
+		reply(out.String(), nil)
+	case "reload":
+		s.reloadConfig(reply)
+	case "quit":
+		a.quit = true
+		reply("", nil)
+	case "help":
+		reply("list | kill <id> | stats | reload | quit\n", nil)
+	default:
+		reply("", fmt.Errorf("unknown command %q", args[0]))
+	}
+}
+
+// eachLoop runs fn on every event loop and passes the results, in loop
+// order, to done on this loop. The other loops run fn from their inbox and
+// post the result back, so fn only touches its own loop's state and no
+// loop ever waits for another.
+func (s *Server) eachLoop(fn func(w *Server) string, done func(results []string)) {
+	loops := s.loops
+	if loops == nil {
+		loops = []*Server{s}
+	}
+	results := make([]string, len(loops))
+	left := len(loops)
+	answer := func(i int, r string) {
+		results[i] = r
+		if left--; left == 0 {
+			done(results)
+		}
+	}
+	for i, w := range loops {
+		if w == s {
+			answer(i, fn(s))
+			continue
+		}
+		posted := w.post(func() {
+			r := fn(w)
+			s.post(func() { answer(i, r) })
+		})
+		if !posted {
+			// a stopped loop has closed all its sessions
+			answer(i, "")
+		}
+	}
+}
+
+// post queues fn for the loop of w and wakes it through its signal pipe.
+// It reports false when that loop has stopped.
+func (w *Server) post(fn func()) bool {
+	w.inboxMu.Lock()
+	defer w.inboxMu.Unlock()
+	if w.stopped {
+		return false
+	}
+	w.inbox = append(w.inbox, fn)
+	if len(w.inbox) == 1 {
+		_, _ = unix.Write(w.wakeFD, []byte{0})
+	}
+	return true
+}
+
+func (s *Server) runInbox() {
+	s.inboxMu.Lock()
+	fns := s.inbox
+	s.inbox = nil
+	s.inboxMu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// stopInbox runs as the loop leaves WaitEvents: work posted before still
+// runs, later posts are refused.
+func (s *Server) stopInbox() {
+	s.inboxMu.Lock()
+	s.stopped = true
+	s.inboxMu.Unlock()
+	s.runInbox()
+}
+
+func protoName(p Protocol) string {
+	switch p {
+	case ProtoSOCKS4:
+		return "socks4"
+	case ProtoHTTP:
+		return "http"
+	}
+	return "socks5"
+}
+
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// sortSessions merges the session lines of every loop in id order.
+func sortSessions(loops []string) string {
+	var lines []string
+	for _, l := range loops {
+		lines = append(lines, strings.SplitAfter(l, "\n")...)
+	}
+	id := func(line string) int {
+		var n int
+		fmt.Sscanf(line, "id=%d", &n)
+		return n
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return id(lines[i]) < id(lines[j])
+	})
+	return strings.Join(lines, "")
+}
+
+func (s *Server) listSessions() string {
+	var ids []int
+	for fd, conn := range s.connections {
+		if fd == conn.fd {
+			ids = append(ids, fd)
+		}
+	}
+
+	var b strings.Builder
+	now := time.Now()
+	for _, id := range ids {
+		conn := s.connections[id]
+		client := "-"
+		if ip, port := sockaddrToIP(conn.caddr); ip != nil {
+			client = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+		}
+		target, remote, via := "-", "-", "-"
+		if conn.host != "" || conn.domain != "" {
+			target = conn.destination()
+		}
+		if conn.raddr != nil {
+			remote = conn.raddr.String()
+		}
+		if conn.via != nil {
+			via = conn.via.String()
+		}
+		fmt.Fprintf(&b, "id=%d state=%s proto=%s client=%s user=%s cmd=%s target=%s remote=%s via=%s up=%d down=%d age=%s idle=%s\n",
+			id, stateNames[conn.state], protoName(conn.proto), client, orDash(conn.user),
+			commandName(conn.cmd), target, remote, via, conn.up.bytes, conn.down.bytes,
+			now.Sub(conn.started).Round(time.Second), now.Sub(conn.lastActive).Round(time.Second))
+	}
+	return b.String()
+}
+
+// writeStats reads the shared metrics, it does not need the other loops.
+func (s *Server) writeStats(out *strings.Builder) {
+	m := s.metrics
+	var total int64
+	for i, name := range stateNames {
+		n := m.states[i].Load()
+		total += n
+		fmt.Fprintf(out, "sessions_%s %d\n", name, n)
+	}
+	fmt.Fprintf(out, "sessions %d\n", total)
+	fmt.Fprintf(out, "accepted %d\n", m.accepted.Load())
+	fmt.Fprintf(out, "rejected %d\n", m.rejected.Load())
+	fmt.Fprintf(out, "connects %d\n", m.connects.Load())
+	fmt.Fprintf(out, "connect_failures %d\n", m.connectErrors.Load())
+	fmt.Fprintf(out, "dns_lookups %d\n", m.dnsLookups.Load())
+	fmt.Fprintf(out, "dns_cache_hits %d\n", m.dnsCacheHits.Load())
+	fmt.Fprintf(out, "bytes_up %d\n", m.bytesUp.Load())
+	fmt.Fprintf(out, "bytes_down %d\n", m.bytesDown.Load())
+	fmt.Fprintf(out, "loops %d\n", max(len(s.loops), 1))
+}
+
+// reloadConfig parses the config file and the command line again and
+// applies what can change at runtime: credentials, rules, timeouts and
+// rate limits. Listeners, workers, buffers and logs need a restart.
+func (s *Server) reloadConfig(reply func(out string, err error)) {
+	opts, err := parseArgs(os.Args[1:], flag.ContinueOnError)
+	if err != nil {
+		reply("", err)
+		return
+	}
+	var users map[string]string
+	if opts.authFile != "" {
+		if users, err = loadCredentials(opts.authFile); err != nil {
+			reply("", err)
+			return
+		}
+	}
+	var rules *ruleSet
+	if opts.rulesFile != "" {
+		if rules, err = loadRules(opts.rulesFile); err != nil {
+			reply("", err)
+			return
+		}
+	}
+	s.limiter.update(opts.limits)
+	s.eachLoop(func(w *Server) string {
+		w.users = users
+		w.rules = rules
+		w.timeouts = opts.timeouts
+		w.drain = opts.drain
+		return ""
+	}, func([]string) {
+		fmt.Println("Reloaded configuration from the admin socket")
+		reply("", nil)
+	})
+}
+
+func (s *Server) closeAdminSocket() {
+	if s.adminFD <= 0 {
+		return
+	}
+	for _, a := range s.admins {
+		a.closed = true
+		unix.Close(a.fd)
+	}
+	s.admins = nil
+	unix.Close(s.adminFD)
+	s.adminFD = 0
+	os.Remove(s.adminPath)
+}
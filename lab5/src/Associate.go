@@ -0,0 +1,163 @@
+package src
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const UDP_HEADER_LEN = 3
+
+// startAssociate opens the relay socket for a UDP ASSOCIATE request. The
+// association lives as long as the controlling TCP connection conn.fd.
+func (s *Server) startAssociate(conn *Conn) error {
+	family := sockaddrFamily(conn.laddr)
+	ufd, err := unix.Socket(family, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	if err = unix.SetNonblock(ufd, true); err != nil {
+		unix.Close(ufd)
+		return err
+	}
+	var local unix.Sockaddr = &unix.SockaddrInet4{}
+	if family == unix.AF_INET6 {
+		// dual-stack so IPv6 clients can still reach IPv4 destinations
+		_ = unix.SetsockoptInt(ufd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+		local = &unix.SockaddrInet6{}
+	}
+	if err = unix.Bind(ufd, local); err != nil {
+		unix.Close(ufd)
+		return err
+	}
+	sa, err := unix.Getsockname(ufd)
+	if err != nil {
+		unix.Close(ufd)
+		return err
+	}
+	_, port := sockaddrToIP(sa)
+
+	if err = s.selecter.Add(ufd, EventRead); err != nil {
+		unix.Close(ufd)
+		return err
+	}
+
+	conn.ufd = ufd
+	conn.ufamily = family
+	s.setState(conn, StateAssociate)
+	s.connections[ufd] = conn
+
+	ip, _ := sockaddrToIP(conn.laddr)
+	s.answerHello(REP_SUCCEEDED, conn.fd, ip, port, "")
+	fmt.Printf("UDP associate on %s\n", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+	return nil
+}
+
+// fromClient reports whether a datagram came from the client that owns the
+// association: same IP as the TCP control connection and, once known, the
+// same source port.
+func (s *Server) fromClient(conn *Conn, from unix.Sockaddr) bool {
+	ip, port := sockaddrToIP(from)
+	clientIP, _ := sockaddrToIP(conn.caddr)
+	if ip == nil || !ip.Equal(clientIP) {
+		return false
+	}
+	if conn.uaddr != nil {
+		_, uport := sockaddrToIP(conn.uaddr)
+		return port == uport
+	}
+	if conn.port != 0 && conn.port != port {
+		return false
+	}
+	conn.uaddr = from
+	return true
+}
+
+func (s *Server) relayUDP(conn *Conn) {
+	buf := make([]byte, bufsize)
+	for {
+		n, from, err := unix.Recvfrom(conn.ufd, buf, 0)
+		if err != nil {
+			if !errors.Is(err, unix.EAGAIN) && !errors.Is(err, unix.EWOULDBLOCK) {
+				fmt.Printf("UDP relay recvfrom: %v\n", err)
+			}
+			return
+		}
+		if from == nil {
+			continue
+		}
+		conn.lastActive = time.Now()
+		if s.fromClient(conn, from) {
+			s.account(conn, &conn.up, n)
+			s.sendToRemote(conn, buf[:n])
+		} else {
+			s.account(conn, &conn.down, n)
+			s.sendToClient(conn, from, buf[:n])
+		}
+	}
+}
+
+func (s *Server) sendToRemote(conn *Conn, data []byte) {
+	if len(data) < UDP_HEADER_LEN || data[2] != ZERO {
+		// fragmentation is not supported, such datagrams are dropped
+		return
+	}
+	addr, n, err := parseAddress(data[UDP_HEADER_LEN:])
+	if err != nil {
+		return
+	}
+	payload := append([]byte(nil), data[UDP_HEADER_LEN+n:]...)
+
+	if addr.ip != nil {
+		if allow, _ := s.allowed(conn, "", addr.ip, addr.port); allow {
+			s.sendDatagram(conn, addr.ip, addr.port, payload)
+		}
+		return
+	}
+	if allow, decided := s.allowed(conn, addr.domain, nil, addr.port); decided && !allow {
+		return
+	}
+
+	s.resolver.lookup(addr.domain, func(addrs []net.IP, err error) {
+		if conn.ufd == 0 {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to resolve host %s: %v\n", addr.domain, err)
+			return
+		}
+		for _, ip := range addrs {
+			if allow, _ := s.allowed(conn, addr.domain, ip, addr.port); !allow {
+				continue
+			}
+			if conn.ufamily == unix.AF_INET6 || ip.To4() != nil {
+				s.sendDatagram(conn, ip, addr.port, payload)
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) sendDatagram(conn *Conn, ip net.IP, port uint16, payload []byte) {
+	sa, err := ipToSockaddrFamily(conn.ufamily, ip, port)
+	if err != nil {
+		return
+	}
+	_ = unix.Sendto(conn.ufd, payload, 0, sa)
+}
+
+func (s *Server) sendToClient(conn *Conn, from unix.Sockaddr, data []byte) {
+	if conn.uaddr == nil {
+		return
+	}
+	ip, port := sockaddrToIP(from)
+	var buf bytes.Buffer
+	buf.Write([]byte{ZERO, ZERO, ZERO})
+	writeAddress(&buf, ip, port, "")
+	buf.Write(data)
+	_ = unix.Sendto(conn.ufd, buf.Bytes(), 0, conn.uaddr)
+}
@@ -0,0 +1,121 @@
+package src
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	METHOD_NO_AUTH       = 0x00
+	METHOD_USER_PASS     = 0x02
+	METHOD_NO_ACCEPTABLE = 0xFF
+
+	AUTH_VERSION = 0x01
+	AUTH_SUCCESS = 0x00
+	AUTH_FAILURE = 0x01
+)
+
+// loadCredentials reads "user:password" lines; empty lines and lines
+// starting with '#' are skipped.
+func loadCredentials(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, line)
+		}
+		if len(user) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("%s:%d: user and password must be at most 255 bytes", path, line)
+		}
+		users[user] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no credentials", path)
+	}
+	return users, nil
+}
+
+func (s *Server) LoadCredentials(path string) error {
+	users, err := loadCredentials(path)
+	if err != nil {
+		return err
+	}
+	s.users = users
+	return nil
+}
+
+func (s *Server) selectMethod(methods []byte) byte {
+	required := byte(METHOD_NO_AUTH)
+	if s.users != nil {
+		required = METHOD_USER_PASS
+	}
+	for _, m := range methods {
+		if m == required {
+			return required
+		}
+	}
+	return METHOD_NO_ACCEPTABLE
+}
+
+func (s *Server) checkCredentials(user, password string) bool {
+	expected, ok := s.users[user]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// processAuth handles the RFC 1929 username/password sub-negotiation.
+func (s *Server) processAuth(conn *Conn, data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, errIncomplete
+	}
+	if data[0] != AUTH_VERSION {
+		return 0, errors.New("auth version != 1")
+	}
+	if len(data) < 2 {
+		return 0, errIncomplete
+	}
+	ulen := int(data[1])
+	if len(data) < 2+ulen+1 {
+		return 0, errIncomplete
+	}
+	user := string(data[2 : 2+ulen])
+	plen := int(data[2+ulen])
+	if len(data) < 3+ulen+plen {
+		return 0, errIncomplete
+	}
+	password := string(data[3+ulen : 3+ulen+plen])
+
+	if !s.checkCredentials(user, password) {
+		_, _ = unix.Write(conn.fd, []byte{AUTH_VERSION, AUTH_FAILURE})
+		s.metrics.rejected.Add(1)
+		return 0, fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, _ = unix.Write(conn.fd, []byte{AUTH_VERSION, AUTH_SUCCESS})
+	conn.user = user
+	s.setState(conn, StateRequest)
+	return 3 + ulen + plen, nil
+}
@@ -0,0 +1,106 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// startBind opens the listening socket for a BIND request and sends the
+// first reply with the address the remote side has to connect to.
+func (s *Server) startBind(conn *Conn) error {
+	if err := s.checkDestination(conn, net.ParseIP(conn.host)); err != nil {
+		return err
+	}
+	ip, _ := sockaddrToIP(conn.laddr)
+	sa, err := ipToSockaddr(ip, 0)
+	if err != nil {
+		return err
+	}
+	lfd, err := unix.Socket(socketFamily(ip), unix.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	if err = unix.SetNonblock(lfd, true); err != nil {
+		unix.Close(lfd)
+		return err
+	}
+	if err = unix.Bind(lfd, sa); err != nil {
+		unix.Close(lfd)
+		return err
+	}
+	if err = unix.Listen(lfd, 1); err != nil {
+		unix.Close(lfd)
+		return err
+	}
+	bound, err := unix.Getsockname(lfd)
+	if err != nil {
+		unix.Close(lfd)
+		return err
+	}
+	_, port := sockaddrToIP(bound)
+
+	if err = s.selecter.Add(lfd, EventRead); err != nil {
+		unix.Close(lfd)
+		return err
+	}
+
+	conn.lfd = lfd
+	s.setState(conn, StateBinding)
+	s.connections[lfd] = conn
+
+	s.replySucceeded(conn, ip, port)
+	fmt.Printf("BIND listening on %s\n", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+	return nil
+}
+
+// expectedPeer reports whether ip may connect to a BIND socket. DST.ADDR
+// of the request names the expected peer, 0.0.0.0 accepts anyone.
+func expectedPeer(conn *Conn, ip net.IP) bool {
+	want := net.ParseIP(conn.host)
+	if want == nil || want.IsUnspecified() {
+		return true
+	}
+	return want.Equal(ip)
+}
+
+// acceptBind takes the inbound connection, sends the second reply with the
+// peer address and switches the session to proxying.
+func (s *Server) acceptBind(conn *Conn) {
+	for {
+		rfd, sa, err := unix.Accept(conn.lfd)
+		if err != nil {
+			if !errors.Is(err, unix.EAGAIN) && !errors.Is(err, unix.EWOULDBLOCK) {
+				s.replyError(conn, err)
+			}
+			return
+		}
+		ip, port := sockaddrToIP(sa)
+		if !expectedPeer(conn, ip) {
+			fmt.Printf("BIND rejected unexpected peer %s:%d\n", ip, port)
+			unix.Close(rfd)
+			continue
+		}
+		_ = unix.SetNonblock(rfd, true)
+		if err := s.selecter.Add(rfd, EventRead); err != nil {
+			unix.Close(rfd)
+			s.replyError(conn, err)
+			return
+		}
+
+		s.selecter.Remove(conn.lfd)
+		unix.Close(conn.lfd)
+		delete(s.connections, conn.lfd)
+		conn.lfd = 0
+		conn.rfd = rfd
+		conn.raddr = ip
+		s.connections[rfd] = conn
+
+		s.replySucceeded(conn, ip, port)
+		fmt.Printf("BIND accepted %s:%d\n", ip, port)
+		s.startProxy(conn)
+		return
+	}
+}
@@ -0,0 +1,210 @@
+package src
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The config file is a small subset of TOML: "key = value" lines, optional
+// [section] headers and # comments. Values are quoted strings, integers,
+// booleans or one-line arrays of strings. Durations and rates are strings
+// ("10s", "2M"). Flags given on the command line override the file.
+//
+//	port = 1080                      # or: listen = ["0.0.0.0:1080", "[::]:1080"]
+//	interface = "eth0"               # default: all addresses
+//	backlog = 128
+//	bufsize = 65536
+//	splice = true
+//	workers = 4
+//	auth = "/etc/lab5/users"
+//	rules = "/etc/lab5/rules"
+//	metrics = "127.0.0.1:9100"
+//	admin = "/run/lab5/admin.sock"
+//
+//	[timeouts]
+//	handshake = "10s"
+//	connect = "30s"
+//	idle = "5m"
+//	drain = "30s"
+//
+//	[limits]
+//	global = "100M"
+//	client = "10M"
+//	user = "10M"
+//
+//	[log]
+//	access = "/var/log/lab5/access.log"
+//	format = "json"
+
+const (
+	minBufsize = 1024
+	maxBufsize = 16 << 20
+)
+
+// stripComment cuts a # comment that is not inside a quoted string.
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func configString(v string) (string, error) {
+	s, err := strconv.Unquote(v)
+	if err != nil || !strings.HasPrefix(v, `"`) {
+		return "", fmt.Errorf("expected a quoted string, got %s", v)
+	}
+	return s, nil
+}
+
+func configInt(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("expected an integer, got %s", v)
+	}
+	return n, nil
+}
+
+func configBool(v string) (bool, error) {
+	switch v {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected true or false, got %s", v)
+}
+
+func configDuration(v string) (time.Duration, error) {
+	s, err := configString(v)
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(s)
+}
+
+func configStrings(v string) ([]string, error) {
+	if !strings.HasPrefix(v, "[") || !strings.HasSuffix(v, "]") {
+		return nil, fmt.Errorf("expected an array of strings, got %s", v)
+	}
+	var out []string
+	for _, item := range strings.Split(v[1:len(v)-1], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		s, err := configString(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func configRate(v string) (int64, error) {
+	if s, err := configString(v); err == nil {
+		return parseRate(s)
+	}
+	return parseRate(v)
+}
+
+// loadConfig applies the settings of file to opts.
+func loadConfig(file string, opts *Options) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	section := ""
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", file, line)
+		}
+		key = strings.TrimSpace(key)
+		if section != "" {
+			key = section + "." + key
+		}
+		if err := opts.set(key, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", file, line, key, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (o *Options) set(key, v string) error {
+	var err error
+	switch key {
+	case "port":
+		o.port, err = configInt(v)
+	case "listen":
+		o.listen, err = configStrings(v)
+	case "interface":
+		o.iface, err = configString(v)
+	case "backlog":
+		o.backlog, err = configInt(v)
+	case "bufsize":
+		o.bufsize, err = configInt(v)
+	case "splice":
+		o.splice, err = configBool(v)
+	case "workers":
+		o.workers, err = configInt(v)
+	case "auth":
+		o.authFile, err = configString(v)
+	case "rules":
+		o.rulesFile, err = configString(v)
+	case "metrics":
+		o.metrics, err = configString(v)
+	case "admin":
+		o.admin, err = configString(v)
+	case "timeouts.handshake":
+		o.timeouts.Handshake, err = configDuration(v)
+	case "timeouts.connect":
+		o.timeouts.Connect, err = configDuration(v)
+	case "timeouts.idle":
+		o.timeouts.Idle, err = configDuration(v)
+	case "timeouts.drain":
+		o.drain, err = configDuration(v)
+	case "limits.global":
+		o.limits.Global, err = configRate(v)
+	case "limits.client":
+		o.limits.Client, err = configRate(v)
+	case "limits.user":
+		o.limits.User, err = configRate(v)
+	case "log.access":
+		o.accessLog, err = configString(v)
+	case "log.format":
+		o.logFormat, err = configString(v)
+	default:
+		return errors.New("unknown setting")
+	}
+	return err
+}
@@ -1,19 +1,83 @@
 package src
 
+import (
+    "net"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
 type State int
 const (
     StateHello State = iota
+    StateAuth
     StateRequest
     StateConnecting
     StateProxy
+    StateAssociate
+    StateBinding
+    StateUpstreamHello   // waiting for the upstream SOCKS5 method choice
+    StateUpstreamAuth    // waiting for the upstream SOCKS5 auth status
+    StateUpstreamRequest // waiting for the upstream SOCKS5 CONNECT reply
+    StateUpstreamHTTP    // waiting for the upstream CONNECT response
+    StateHTTPRequest     // reading the request head of an HTTP client
+)
+
+// Protocol is what the client speaks, detected from its first byte.
+type Protocol int
+const (
+    ProtoSOCKS5 Protocol = iota
+    ProtoSOCKS4 // SOCKS4 and SOCKS4a
+    ProtoHTTP
 )
 
 type Conn struct {
     fd     int     
     rfd    int     
+    ufd    int
+    lfd    int
 	state  State
     domain string
     host string
     port uint16
     resolving bool
-}
\ No newline at end of file
+    user string
+    cmd byte
+    caddr unix.Sockaddr
+    laddr unix.Sockaddr
+    uaddr unix.Sockaddr
+    ufamily int
+    up   stream
+    down stream
+    addrs     []net.IP
+    attempts  map[int]net.IP
+    raceTimer *timer
+    lastErr   error
+    deadline   *timer
+    lastActive time.Time
+    in         []byte // handshake bytes not consumed yet
+    started    time.Time
+    raddr      net.IP // address actually connected to
+    rep        byte   // reply code sent for the request
+    reason     string // why the session was closed
+    buckets    []*tokenBucket
+    via        *upstream // proxy chained through, nil when direct
+    reply      []byte    // upstream handshake bytes not consumed yet
+    proto      Protocol
+    forward    bool // HTTP request forwarded in origin form, no tunnel reply
+    dialed     time.Time // when connecting to the destination started
+}
+
+// stream is one direction of a proxied session: bytes read from the source
+// that the destination socket has not accepted yet.
+type stream struct {
+    pending  []byte
+    paused   bool
+    eof      bool   // source sent FIN
+    shut     bool   // FIN forwarded to the destination
+    bytes    uint64 // read from the source
+    throttle *timer // set while the source waits for rate limit tokens
+    pipe     [2]int // splice pipe, zero when the stream is copied
+    pipeCap  int
+    piped    int    // bytes in the pipe
+}
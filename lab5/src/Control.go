@@ -1,13 +1,49 @@
 package src
 
+import (
+	"flag"
+	"fmt"
+	"os"
+)
 
 func ExecuteServer() {
 	server := NewServer()
-	port := parseArgs()
-	if port == -1 {
+	opts, err := parseArgs(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
 		return
 	}
-	server.InitSocket(port)
-	server.InitSelecter()
-	server.WaitEvents();
-}
\ No newline at end of file
+	if opts.authFile != "" {
+		if err := server.LoadCredentials(opts.authFile); err != nil {
+			fmt.Printf("Failed load credentials: %v\n", err)
+			return
+		}
+	}
+	if opts.rulesFile != "" {
+		if err := server.LoadRules(opts.rulesFile); err != nil {
+			fmt.Printf("Failed load rules: %v\n", err)
+			return
+		}
+	}
+	if opts.accessLog != "" {
+		if err := server.OpenAccessLog(opts.accessLog, opts.logFormat); err != nil {
+			fmt.Printf("Failed open access log: %v\n", err)
+			return
+		}
+	}
+	server.SetTimeouts(opts.timeouts)
+	server.SetRateLimits(opts.limits)
+	server.SetDrainTimeout(opts.drain)
+	server.SetBuffers(opts.backlog, opts.bufsize)
+	server.SetSplice(opts.splice)
+	server.SetAdminSocket(opts.admin)
+	if opts.metrics != "" {
+		if err := server.ServeMetrics(opts.metrics); err != nil {
+			fmt.Printf("Failed serve metrics: %v\n", err)
+			return
+		}
+	}
+	if err := server.RunWorkers(opts.workers, opts.addrs); err != nil {
+		fmt.Printf("Failed start server: %v\n", err)
+	}
+}
@@ -0,0 +1,111 @@
+package src
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	dnsCacheSize   = 1024
+	dnsNegativeTTL = 30 * time.Second
+	dnsMaxTTL      = 24 * time.Hour
+)
+
+type dnsCacheEntry struct {
+	name    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// dnsCache keeps resolved names until their TTL runs out. NXDOMAIN answers
+// are cached for dnsNegativeTTL; when the cache is full the least recently
+// used entry is evicted.
+type dnsCache struct {
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *dnsCache) get(name string) ([]net.IP, error, bool) {
+	el, ok := c.entries[name]
+	if !ok {
+		c.misses++
+		return nil, nil, false
+	}
+	e := el.Value.(*dnsCacheEntry)
+	if !time.Now().Before(e.expires) {
+		c.remove(el)
+		c.misses++
+		return nil, nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return e.ips, e.err, true
+}
+
+func (c *dnsCache) put(name string, ips []net.IP, err error, ttl time.Duration) {
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+	if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+	e := &dnsCacheEntry{name: name, ips: ips, err: err, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[name]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[name] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *dnsCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*dnsCacheEntry).name)
+	c.lru.Remove(el)
+}
+
+// dump writes the live entries sorted by name with their remaining TTL.
+func (c *dnsCache) dump(w io.Writer) {
+	now := time.Now()
+	var entries []*dnsCacheEntry
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*dnsCacheEntry)
+		if now.Before(e.expires) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	fmt.Fprintf(w, "DNS cache: %d entries, %d hits, %d misses\n", len(entries), c.hits, c.misses)
+	for _, e := range entries {
+		ttl := e.expires.Sub(now).Truncate(time.Second)
+		if e.err != nil {
+			fmt.Fprintf(w, "%s\tttl=%s\tNXDOMAIN\n", e.name, ttl)
+			continue
+		}
+		ips := make([]string, len(e.ips))
+		for i, ip := range e.ips {
+			ips[i] = ip.String()
+		}
+		fmt.Fprintf(w, "%s\tttl=%s\t%s\n", e.name, ttl, strings.Join(ips, " "))
+	}
+}
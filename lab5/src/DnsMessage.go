@@ -0,0 +1,137 @@
+package src
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	DNS_TYPE_A     = 1
+	DNS_TYPE_CNAME = 5
+	DNS_TYPE_AAAA  = 28
+	DNS_CLASS_IN   = 1
+
+	DNS_HEADER_LEN = 12
+	DNS_FLAG_QR    = 0x8000
+	DNS_FLAG_TC    = 0x0200
+	DNS_FLAG_RD    = 0x0100
+	DNS_RCODE_MASK = 0x000F
+
+	DNS_RCODE_NOERROR  = 0
+	DNS_RCODE_NXDOMAIN = 3
+
+	maxDomainLen = 253
+	maxLabelLen  = 63
+)
+
+var errDNSFormat = errors.New("malformed DNS message")
+
+type dnsAnswer struct {
+	id    uint16
+	rcode int
+	ips   []net.IP
+	ttl   uint32
+}
+
+// buildQuery encodes a recursive query for one name and record type.
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > maxDomainLen {
+		return nil, errors.New("invalid domain name length")
+	}
+	msg := make([]byte, DNS_HEADER_LEN, DNS_HEADER_LEN+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], DNS_FLAG_RD)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxLabelLen {
+			return nil, errors.New("invalid domain name label")
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, DNS_CLASS_IN)
+	return msg, nil
+}
+
+// skipName returns the offset just past a possibly compressed name at off.
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSFormat
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return 0, errDNSFormat
+			}
+			return off + 2, nil
+		case l&0xC0 != 0:
+			return 0, errDNSFormat
+		}
+		off += 1 + l
+	}
+}
+
+// parseAnswer extracts the A/AAAA records of qtype from a response and the
+// smallest TTL among them. CNAME chains are followed implicitly because a
+// recursive server puts the final records into the same answer section.
+func parseAnswer(msg []byte, qtype uint16) (dnsAnswer, error) {
+	var ans dnsAnswer
+	if len(msg) < DNS_HEADER_LEN {
+		return ans, errDNSFormat
+	}
+	ans.id = binary.BigEndian.Uint16(msg[0:])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&DNS_FLAG_QR == 0 {
+		return ans, errDNSFormat
+	}
+	ans.rcode = int(flags & DNS_RCODE_MASK)
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := DNS_HEADER_LEN
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return ans, err
+		}
+		off += 4
+	}
+	for i := 0; i < ancount; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return ans, err
+		}
+		if off+10 > len(msg) {
+			return ans, errDNSFormat
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return ans, errDNSFormat
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+		if class != DNS_CLASS_IN || rtype != qtype {
+			continue
+		}
+		if (rtype == DNS_TYPE_A && rdlen != net.IPv4len) || (rtype == DNS_TYPE_AAAA && rdlen != net.IPv6len) {
+			return ans, errDNSFormat
+		}
+		if len(ans.ips) == 0 || ttl < ans.ttl {
+			ans.ttl = ttl
+		}
+		ans.ips = append(ans.ips, net.IP(append([]byte(nil), rdata...)))
+	}
+	return ans, nil
+}
@@ -0,0 +1,214 @@
+package src
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxHTTPHeadLen bounds the request line and headers of an HTTP client,
+// which are a lot longer than a SOCKS handshake.
+const maxHTTPHeadLen = 16384
+
+// hop-by-hop headers that are not passed on to the origin server
+var proxyHeaders = map[string]bool{
+	"proxy-connection":    true,
+	"proxy-authorization": true,
+	"connection":          true,
+	"keep-alive":          true,
+}
+
+var statusText = map[int]string{
+	200: "Connection established",
+	400: "Bad Request",
+	403: "Forbidden",
+	407: "Proxy Authentication Required",
+	431: "Request Header Fields Too Large",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+}
+
+// httpError is a request the HTTP front end rejects with status.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func newHTTPError(status int, format string, args ...interface{}) *httpError {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// isHTTPMethod tells an HTTP request line from a SOCKS version byte.
+func isHTTPMethod(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// httpStatus maps a failed request to the status sent to an HTTP client.
+func httpStatus(err error) int {
+	if he, ok := err.(*httpError); ok {
+		return he.status
+	}
+	if err == errShuttingDown {
+		return 503
+	}
+	switch replyCode(err) {
+	case REP_NOT_ALLOWED:
+		return 403
+	case REP_TTL_EXPIRED:
+		return 504
+	case REP_COMMAND_NOT_SUPPORTED, REP_ADDRESS_NOT_SUPPORTED:
+		return 400
+	}
+	return 502
+}
+
+func (s *Server) replyHTTP(conn *Conn, status int) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", status, statusText[status])
+	if status != 200 {
+		if status == 407 {
+			buf.WriteString("Proxy-Authenticate: Basic realm=\"proxy\"\r\n")
+		}
+		buf.WriteString("Content-Length: 0\r\nConnection: close\r\n")
+	}
+	buf.WriteString("\r\n")
+	_, _ = unix.Write(conn.fd, buf.Bytes())
+}
+
+// processHTTPRequest parses the request head of an HTTP proxy client. A
+// CONNECT request becomes a tunnel; any other method must use an absolute
+// http:// URI and is forwarded with the head rewritten to origin form.
+func (s *Server) processHTTPRequest(conn *Conn, data []byte) (int, error) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return 0, errIncomplete
+	}
+	if end > maxHTTPHeadLen {
+		return 0, newHTTPError(431, "request header too long")
+	}
+	lines := strings.Split(string(data[:end]), "\r\n")
+	request := strings.Fields(lines[0])
+	if len(request) != 3 || !strings.HasPrefix(request[2], "HTTP/1.") {
+		return 0, newHTTPError(400, "invalid request line %q", lines[0])
+	}
+	method, uri, version := request[0], request[1], request[2]
+
+	var headers [][2]string
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return 0, newHTTPError(400, "invalid header line %q", line)
+		}
+		headers = append(headers, [2]string{strings.TrimSpace(name), strings.TrimSpace(value)})
+	}
+	if err := s.httpAuth(conn, headers); err != nil {
+		return 0, err
+	}
+	conn.cmd = CMD_CONNECT
+
+	if method == "CONNECT" {
+		host, port, err := net.SplitHostPort(uri)
+		if err != nil {
+			return 0, newHTTPError(400, "invalid CONNECT target %q", uri)
+		}
+		if err := setHTTPTarget(conn, host, port); err != nil {
+			return 0, err
+		}
+		fmt.Printf("HTTP CONNECT %s\n", uri)
+		return end + 4, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return 0, newHTTPError(400, "%s %s: absolute http:// URI required", method, uri)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	if err := setHTTPTarget(conn, u.Hostname(), port); err != nil {
+		return 0, err
+	}
+	fmt.Printf("HTTP %s %s\n", method, uri)
+
+	// One request per connection: the rest of the stream is tunnelled to
+	// this origin, so keep-alive is turned off on the way there.
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s %s\r\n", method, u.RequestURI(), version)
+	hasHost := false
+	for _, h := range headers {
+		if proxyHeaders[strings.ToLower(h[0])] {
+			continue
+		}
+		if strings.EqualFold(h[0], "Host") {
+			hasHost = true
+		}
+		fmt.Fprintf(&head, "%s: %s\r\n", h[0], h[1])
+	}
+	if !hasHost {
+		fmt.Fprintf(&head, "Host: %s\r\n", u.Host)
+	}
+	head.WriteString("Connection: close\r\n\r\n")
+
+	// the rewritten head takes the place of the original one in conn.in,
+	// so nothing is consumed and startProxy sends it upstream
+	conn.forward = true
+	conn.in = append(head.Bytes(), data[end+4:]...)
+	return 0, nil
+}
+
+// httpAuth requires Basic Proxy-Authorization when credentials are loaded.
+func (s *Server) httpAuth(conn *Conn, headers [][2]string) error {
+	if s.users == nil {
+		return nil
+	}
+	for _, h := range headers {
+		if !strings.EqualFold(h[0], "Proxy-Authorization") {
+			continue
+		}
+		scheme, cred, _ := strings.Cut(h[1], " ")
+		if !strings.EqualFold(scheme, "Basic") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+		if err != nil {
+			continue
+		}
+		user, password, _ := strings.Cut(string(raw), ":")
+		if !s.checkCredentials(user, password) {
+			return newHTTPError(407, "authentication failed for user %q", user)
+		}
+		conn.user = user
+		return nil
+	}
+	return newHTTPError(407, "proxy authentication required")
+}
+
+func setHTTPTarget(conn *Conn, host, port string) error {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return newHTTPError(400, "invalid port %q", port)
+	}
+	if host == "" || len(host) > 255 {
+		return newHTTPError(400, "invalid host %q", host)
+	}
+	conn.host = host
+	conn.domain = ""
+	if net.ParseIP(host) == nil {
+		conn.domain = host
+	}
+	conn.port = uint16(p)
+	return nil
+}
@@ -0,0 +1,158 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// stateNames labels the session gauge, indexed by State.
+var stateNames = [...]string{
+	StateHello:           "hello",
+	StateAuth:            "auth",
+	StateRequest:         "request",
+	StateConnecting:      "connecting",
+	StateProxy:           "proxy",
+	StateAssociate:       "associate",
+	StateBinding:         "binding",
+	StateUpstreamHello:   "upstream_hello",
+	StateUpstreamAuth:    "upstream_auth",
+	StateUpstreamRequest: "upstream_request",
+	StateUpstreamHTTP:    "upstream_http",
+	StateHTTPRequest:     "http_request",
+}
+
+// latencyBuckets are the upper bounds of the latency histograms.
+var latencyBuckets = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+type histogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Uint64 // the last one is +Inf
+	sum    atomic.Int64                           // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) write(buf *bytes.Buffer, name, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var total uint64
+	for i, le := range latencyBuckets {
+		total += h.counts[i].Load()
+		fmt.Fprintf(buf, "%s_bucket{le=\"%g\"} %d\n", name, le.Seconds(), total)
+	}
+	total += h.counts[len(latencyBuckets)].Load()
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, total)
+	fmt.Fprintf(buf, "%s_sum %g\n", name, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(buf, "%s_count %d\n", name, total)
+}
+
+// metrics is shared by all event loops, so every field is atomic.
+type metrics struct {
+	states         [len(stateNames)]atomic.Int64
+	accepted       atomic.Uint64
+	rejected       atomic.Uint64 // failed authentication or denied by rules
+	connects       atomic.Uint64
+	connectErrors  atomic.Uint64
+	dnsLookups     atomic.Uint64
+	dnsCacheHits   atomic.Uint64
+	bytesUp        atomic.Uint64
+	bytesDown      atomic.Uint64
+	handshake      histogram
+	connectLatency histogram
+	server         *http.Server
+}
+
+func newMetrics() *metrics {
+	return &metrics{}
+}
+
+func (m *metrics) move(from, to State) {
+	if from == to {
+		return
+	}
+	m.states[from].Add(-1)
+	m.states[to].Add(1)
+}
+
+func (m *metrics) relayed(up bool, n int) {
+	if up {
+		m.bytesUp.Add(uint64(n))
+	} else {
+		m.bytesDown.Add(uint64(n))
+	}
+}
+
+func writeCounter(buf *bytes.Buffer, name, help string, v uint64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	buf.WriteString("# HELP socks_sessions Open sessions by state.\n# TYPE socks_sessions gauge\n")
+	for i, name := range stateNames {
+		fmt.Fprintf(&buf, "socks_sessions{state=%q} %d\n", name, m.states[i].Load())
+	}
+	writeCounter(&buf, "socks_connections_accepted_total", "Client connections accepted.", m.accepted.Load())
+	writeCounter(&buf, "socks_connections_rejected_total", "Sessions refused by authentication or rules.", m.rejected.Load())
+	writeCounter(&buf, "socks_connects_total", "Connections to destinations established.", m.connects.Load())
+	writeCounter(&buf, "socks_connect_failures_total", "Connections to destinations that failed or timed out.", m.connectErrors.Load())
+	writeCounter(&buf, "socks_dns_lookups_total", "Host names resolved.", m.dnsLookups.Load())
+	writeCounter(&buf, "socks_dns_cache_hits_total", "Host names answered from the DNS cache.", m.dnsCacheHits.Load())
+	buf.WriteString("# HELP socks_bytes_total Bytes relayed.\n# TYPE socks_bytes_total counter\n")
+	fmt.Fprintf(&buf, "socks_bytes_total{direction=\"up\"} %d\n", m.bytesUp.Load())
+	fmt.Fprintf(&buf, "socks_bytes_total{direction=\"down\"} %d\n", m.bytesDown.Load())
+	m.handshake.write(&buf, "socks_handshake_seconds", "Time from accept until the request was read.")
+	m.connectLatency.write(&buf, "socks_connect_seconds", "Time from the request until the destination was connected.")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// ServeMetrics serves the metrics on addr at /metrics. The HTTP server
+// runs on its own goroutines next to the event loops.
+func (s *Server) ServeMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics)
+	s.metrics.server = &http.Server{Handler: mux}
+	go s.metrics.server.Serve(ln)
+	fmt.Printf("Serving metrics on http://%s/metrics\n", ln.Addr())
+	return nil
+}
+
+func (m *metrics) Close() {
+	if m.server != nil {
+		m.server.Close()
+	}
+}
+
+// account counts n bytes relayed on st.
+func (s *Server) account(conn *Conn, st *stream, n int) {
+	st.bytes += uint64(n)
+	s.metrics.relayed(st == &conn.up, n)
+}
@@ -1,21 +1,227 @@
 package src
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+type Options struct {
+	port      int
+	listen    []string
+	iface     string
+	backlog   int
+	bufsize   int
+	splice    bool
+	authFile  string
+	rulesFile string
+	timeouts  Timeouts
+	accessLog string
+	logFormat string
+	limits    RateLimits
+	workers   int
+	drain     time.Duration
+	metrics   string
+	admin     string
+	addrs     []listenAddr // resolved from listen or iface and port
+}
 
-func parseArgs() int {
-	if (len(os.Args) < 2) {
-		fmt.Println("Invalid arguments : <Name app> <port server>")
-		return -1
+func defaultOptions() *Options {
+	return &Options{
+		backlog: countClient,
+		bufsize: bufsize,
+		timeouts: Timeouts{
+			Handshake: defaultHandshakeTimeout,
+			Connect:   defaultConnectTimeout,
+			Idle:      defaultIdleTimeout,
+		},
+		logFormat: LOG_FORMAT_JSON,
+		workers:   1,
+		drain:     defaultDrainTimeout,
 	}
-	port, err := strconv.Atoi(os.Args[1])
+}
+
+// configPath finds -config before the flags are parsed, so that the file
+// provides the defaults the flags override.
+func configPath(args []string) string {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		name := strings.TrimLeft(a, "-")
+		if len(name) == len(a) {
+			continue
+		}
+		if v, ok := strings.CutPrefix(name, "config="); ok {
+			return v
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// parseArgs builds the options from the config file and the command line.
+// It runs again when the admin socket asks for a reload.
+func parseArgs(args []string, handling flag.ErrorHandling) (*Options, error) {
+	opts := defaultOptions()
+	if path := configPath(args); path != "" {
+		if err := loadConfig(path, opts); err != nil {
+			return nil, fmt.Errorf("config: %v", err)
+		}
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], handling)
+	fs.String("config", "", "config file, its settings are the defaults of the other flags")
+	listenSet := false
+	fs.Func("listen", "address to listen on, ip:port or [ipv6]:port; repeat for several", func(v string) error {
+		if !listenSet {
+			// the flags replace the addresses of the config file
+			opts.listen = nil
+			listenSet = true
+		}
+		opts.listen = append(opts.listen, v)
+		return nil
+	})
+	fs.StringVar(&opts.iface, "interface", opts.iface, "listen on the addresses of this interface instead of all addresses")
+	fs.IntVar(&opts.backlog, "backlog", opts.backlog, "listen backlog")
+	fs.IntVar(&opts.bufsize, "bufsize", opts.bufsize, "relay buffer size in bytes")
+	fs.BoolVar(&opts.splice, "splice", opts.splice, "relay TCP sessions with splice(2) through pipes, Linux only")
+	fs.StringVar(&opts.authFile, "auth", opts.authFile, "file with user:password lines, enables SOCKS5 username/password auth")
+	fs.StringVar(&opts.rulesFile, "rules", opts.rulesFile, "access rules file, reloaded on SIGHUP")
+	fs.DurationVar(&opts.timeouts.Handshake, "handshake-timeout", opts.timeouts.Handshake, "time allowed for the SOCKS handshake, 0 disables")
+	fs.DurationVar(&opts.timeouts.Connect, "connect-timeout", opts.timeouts.Connect, "time allowed for resolving and connecting upstream, 0 disables")
+	fs.DurationVar(&opts.timeouts.Idle, "idle-timeout", opts.timeouts.Idle, "close proxied sessions without traffic for this long, 0 disables")
+	fs.StringVar(&opts.accessLog, "access-log", opts.accessLog, "append one line per finished session to this file")
+	fs.StringVar(&opts.logFormat, "access-log-format", opts.logFormat, "access log format: json or common")
+	fs.Func("rate-limit", "total bytes per second for all sessions, with K/M/G suffix", rateFlag(&opts.limits.Global))
+	fs.Func("client-rate-limit", "bytes per second for the sessions of one client IP", rateFlag(&opts.limits.Client))
+	fs.Func("user-rate-limit", "bytes per second for the sessions of one authenticated user", rateFlag(&opts.limits.User))
+	fs.DurationVar(&opts.drain, "drain-timeout", opts.drain, "on SIGTERM/SIGINT, time proxied sessions get to finish")
+	fs.StringVar(&opts.metrics, "metrics", opts.metrics, "serve Prometheus metrics at /metrics on this address, e.g. 127.0.0.1:9100")
+	fs.StringVar(&opts.admin, "admin", opts.admin, "Unix socket for admin commands: list, kill <id>, stats, reload")
+	fs.IntVar(&opts.workers, "workers", opts.workers, "number of event loops, each with its own SO_REUSEPORT listener")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 1 {
+		return nil, errors.New("usage: <Name app> [options] [port server]")
+	}
+	if fs.NArg() == 1 {
+		port, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port server %q", fs.Arg(0))
+		}
+		opts.port = port
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// validate checks the settings together and resolves the listen addresses.
+func (o *Options) validate() error {
+	switch {
+	case o.backlog < 1:
+		return fmt.Errorf("backlog must be positive, got %d", o.backlog)
+	case o.bufsize < minBufsize || o.bufsize > maxBufsize:
+		return fmt.Errorf("bufsize must be between %d and %d, got %d", minBufsize, maxBufsize, o.bufsize)
+	case o.splice && !spliceSupported:
+		return errors.New("splice relaying is only available on Linux")
+	case o.workers < 1:
+		return fmt.Errorf("workers must be positive, got %d", o.workers)
+	case o.timeouts.Handshake < 0 || o.timeouts.Connect < 0 || o.timeouts.Idle < 0 || o.drain < 0:
+		return errors.New("timeouts must not be negative")
+	case o.logFormat != LOG_FORMAT_JSON && o.logFormat != LOG_FORMAT_COMMON:
+		return fmt.Errorf("unknown access log format %q", o.logFormat)
+	case o.limits.Global < 0 || o.limits.Client < 0 || o.limits.User < 0:
+		return errors.New("rate limits must not be negative")
+	}
+
+	if len(o.listen) > 0 {
+		if o.port != 0 {
+			return errors.New("give either listen addresses or a port, not both")
+		}
+		for _, l := range o.listen {
+			a, err := parseListenAddr(l)
+			if err != nil {
+				return err
+			}
+			o.addrs = append(o.addrs, a)
+		}
+		return nil
+	}
+	if o.port < 1 || o.port > 65535 {
+		return fmt.Errorf("invalid port server %d, give a port or listen addresses", o.port)
+	}
+	if o.iface == "" {
+		o.addrs = defaultAddrs(o.port)
+		return nil
+	}
+	addrs, err := interfaceAddrs(o.iface, o.port)
 	if err != nil {
-		fmt.Println("Invalid port server")
-		return -1
+		return err
+	}
+	o.addrs = addrs
+	return nil
+}
+
+func parseListenAddr(s string) (listenAddr, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return listenAddr{}, fmt.Errorf("invalid listen address %q: %v", s, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return listenAddr{}, fmt.Errorf("invalid listen address %q: host must be an IP address", s)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return listenAddr{}, fmt.Errorf("invalid listen address %q: bad port", s)
+	}
+	return listenAddr{ip: ip, port: port}, nil
+}
+
+// parseRate parses a byte rate such as 512K or 10M.
+func parseRate(v string) (int64, error) {
+	if v == "" {
+		return 0, errors.New("empty rate")
+	}
+	mult := int64(1)
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	num := v
+	if mult > 1 {
+		num = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", v)
+	}
+	return n * mult, nil
+}
+
+func rateFlag(dst *int64) func(string) error {
+	return func(v string) error {
+		n, err := parseRate(v)
+		if err != nil {
+			return err
+		}
+		*dst = n
+		return nil
 	}
-	return port
-}
\ No newline at end of file
+}
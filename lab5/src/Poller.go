@@ -0,0 +1,23 @@
+package src
+
+const (
+	EventRead uint32 = 1 << iota
+	EventWrite
+)
+
+type Event struct {
+	Fd       int
+	Readable bool
+	Writable bool
+}
+
+// Poller hides the OS readiness API (epoll on Linux, kqueue on BSD/macOS).
+// Registrations are edge-triggered on every backend.
+type Poller interface {
+	Add(fd int, events uint32) error
+	Modify(fd int, events uint32) error
+	Remove(fd int) error
+	// Wait blocks for at most timeout milliseconds, -1 means forever.
+	Wait(events []Event, timeout int) (int, error)
+	Close() error
+}
@@ -0,0 +1,98 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package src
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+type kqueuePoller struct {
+	kq         int
+	registered map[int]uint32
+	events     []unix.Kevent_t
+}
+
+func newPoller() (Poller, error) {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	return &kqueuePoller{kq: kq, registered: make(map[int]uint32)}, nil
+}
+
+func (p *kqueuePoller) apply(fd int, old, events uint32) error {
+	var changes []unix.Kevent_t
+	filters := []struct {
+		flag   uint32
+		filter int
+	}{
+		{EventRead, unix.EVFILT_READ},
+		{EventWrite, unix.EVFILT_WRITE},
+	}
+	for _, f := range filters {
+		var change unix.Kevent_t
+		if events&f.flag != 0 {
+			unix.SetKevent(&change, fd, f.filter, unix.EV_ADD|unix.EV_CLEAR)
+		} else if old&f.flag != 0 {
+			unix.SetKevent(&change, fd, f.filter, unix.EV_DELETE)
+		} else {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	_, err := unix.Kevent(p.kq, changes, nil, nil)
+	return err
+}
+
+func (p *kqueuePoller) Add(fd int, events uint32) error {
+	if err := p.apply(fd, 0, events); err != nil {
+		return err
+	}
+	p.registered[fd] = events
+	return nil
+}
+
+func (p *kqueuePoller) Modify(fd int, events uint32) error {
+	if err := p.apply(fd, p.registered[fd], events); err != nil {
+		return err
+	}
+	p.registered[fd] = events
+	return nil
+}
+
+func (p *kqueuePoller) Remove(fd int) error {
+	old := p.registered[fd]
+	delete(p.registered, fd)
+	return p.apply(fd, old, 0)
+}
+
+func (p *kqueuePoller) Wait(events []Event, timeout int) (int, error) {
+	if len(p.events) < len(events) {
+		p.events = make([]unix.Kevent_t, len(events))
+	}
+	var ts *unix.Timespec
+	if timeout >= 0 {
+		t := unix.NsecToTimespec(int64(timeout) * 1e6)
+		ts = &t
+	}
+	n, err := unix.Kevent(p.kq, nil, p.events[:len(events)], ts)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		ev := p.events[i]
+		events[i] = Event{
+			Fd:       int(ev.Ident),
+			Readable: ev.Filter == unix.EVFILT_READ,
+			Writable: ev.Filter == unix.EVFILT_WRITE,
+		}
+	}
+	return n, nil
+}
+
+func (p *kqueuePoller) Close() error {
+	return unix.Close(p.kq)
+}
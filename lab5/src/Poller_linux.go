@@ -0,0 +1,68 @@
+//go:build linux
+
+package src
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+type epollPoller struct {
+	epfd   int
+	events []unix.EpollEvent
+}
+
+func newPoller() (Poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epollPoller{epfd: epfd}, nil
+}
+
+func epollMask(events uint32) uint32 {
+	mask := uint32(unix.EPOLLET | unix.EPOLLRDHUP)
+	if events&EventRead != 0 {
+		mask |= unix.EPOLLIN
+	}
+	if events&EventWrite != 0 {
+		mask |= unix.EPOLLOUT
+	}
+	return mask
+}
+
+func (p *epollPoller) Add(fd int, events uint32) error {
+	ev := unix.EpollEvent{Events: epollMask(events), Fd: int32(fd)}
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, fd, &ev)
+}
+
+func (p *epollPoller) Modify(fd int, events uint32) error {
+	ev := unix.EpollEvent{Events: epollMask(events), Fd: int32(fd)}
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_MOD, fd, &ev)
+}
+
+func (p *epollPoller) Remove(fd int) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *epollPoller) Wait(events []Event, timeout int) (int, error) {
+	if len(p.events) < len(events) {
+		p.events = make([]unix.EpollEvent, len(events))
+	}
+	n, err := unix.EpollWait(p.epfd, p.events[:len(events)], timeout)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		mask := p.events[i].Events
+		events[i] = Event{
+			Fd:       int(p.events[i].Fd),
+			Readable: mask&(unix.EPOLLIN|unix.EPOLLRDHUP|unix.EPOLLHUP|unix.EPOLLERR) != 0,
+			Writable: mask&(unix.EPOLLOUT|unix.EPOLLHUP|unix.EPOLLERR) != 0,
+		}
+	}
+	return n, nil
+}
+
+func (p *epollPoller) Close() error {
+	return unix.Close(p.epfd)
+}
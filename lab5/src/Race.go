@@ -0,0 +1,175 @@
+package src
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// connectionAttemptDelay is the RFC 8305 delay before the next address is
+// tried while earlier attempts are still pending.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// interleave orders addresses RFC 8305 style: IPv6 first, then alternating
+// between the families.
+func interleave(addrs []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(addrs))
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			out = append(out, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			out = append(out, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return out
+}
+
+func (c *Conn) isAttempt(fd int) bool {
+	_, ok := c.attempts[fd]
+	return ok
+}
+
+// startRace begins connecting to every address in conn.addrs, one attempt
+// every connectionAttemptDelay until one of them completes.
+func (s *Server) startRace(conn *Conn, addrs []net.IP) error {
+	conn.addrs = addrs
+	if conn.via == nil {
+		conn.addrs = s.filterAddrs(conn, addrs)
+	}
+	if len(conn.addrs) == 0 {
+		return newSocksError(REP_NOT_ALLOWED, "connection to %s not allowed by ruleset", net.JoinHostPort(conn.host, fmt.Sprint(conn.port)))
+	}
+	conn.attempts = make(map[int]net.IP)
+	if conn.state != StateConnecting {
+		s.setState(conn, StateConnecting)
+	}
+	return s.nextAttempt(conn)
+}
+
+// nextAttempt starts a connect to the next address that does not fail
+// immediately and arms the timer for the one after it. It returns an error
+// only when nothing is left in flight.
+func (s *Server) nextAttempt(conn *Conn) error {
+	s.timers.stop(conn.raceTimer)
+	conn.raceTimer = nil
+
+	_, port := conn.target()
+	for len(conn.addrs) > 0 {
+		ip := conn.addrs[0]
+		conn.addrs = conn.addrs[1:]
+
+		fd, err := s.dial(ip, port)
+		if err != nil {
+			conn.lastErr = err
+			continue
+		}
+		conn.attempts[fd] = ip
+		s.connections[fd] = conn
+
+		if len(conn.addrs) > 0 {
+			conn.raceTimer = s.timers.after(connectionAttemptDelay, func() {
+				conn.raceTimer = nil
+				if conn.state != StateConnecting {
+					return
+				}
+				if err := s.nextAttempt(conn); err != nil {
+					s.replyError(conn, err)
+				}
+			})
+		}
+		return nil
+	}
+
+	if len(conn.attempts) > 0 {
+		return nil
+	}
+	if conn.lastErr != nil {
+		return conn.lastErr
+	}
+	return newSocksError(REP_HOST_UNREACHABLE, "no addresses for %s", conn.host)
+}
+
+func (s *Server) dial(ip net.IP, port uint16) (int, error) {
+	addr, err := ipToSockaddr(ip, port)
+	if err != nil {
+		return -1, newSocksError(REP_ADDRESS_NOT_SUPPORTED, "%v", err)
+	}
+	fd, err := unix.Socket(socketFamily(ip), unix.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, err
+	}
+	_ = unix.SetNonblock(fd, true)
+
+	err = unix.Connect(fd, addr)
+	if err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return -1, err
+	}
+	if err := s.selecter.Add(fd, EventWrite); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (s *Server) dropAttempt(conn *Conn, fd int) {
+	s.selecter.Remove(fd)
+	unix.Close(fd)
+	delete(s.connections, fd)
+	delete(conn.attempts, fd)
+}
+
+// stopRace closes every attempt except the winner and the pending timer.
+func (s *Server) stopRace(conn *Conn, winner int) {
+	s.timers.stop(conn.raceTimer)
+	conn.raceTimer = nil
+	for fd := range conn.attempts {
+		if fd != winner {
+			s.dropAttempt(conn, fd)
+		}
+	}
+	conn.attempts = nil
+	conn.addrs = nil
+}
+
+// attemptDone handles the write event of an attempt: a failure moves on
+// to the next address immediately, a success wins the race.
+func (s *Server) attemptDone(conn *Conn, fd int) {
+	serr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && serr != 0 {
+		err = unix.Errno(serr)
+	}
+	if err != nil {
+		_, port := conn.target()
+		fmt.Printf("Connect to %s failed: %v\n", net.JoinHostPort(conn.attempts[fd].String(), fmt.Sprint(port)), err)
+		conn.lastErr = err
+		s.dropAttempt(conn, fd)
+		if err := s.nextAttempt(conn); err != nil {
+			s.replyError(conn, err)
+		}
+		return
+	}
+
+	conn.raddr = conn.attempts[fd]
+	s.stopRace(conn, fd)
+	conn.rfd = fd
+	if conn.via != nil {
+		s.startUpstream(conn)
+		return
+	}
+	conn.host = conn.raddr.String()
+	s.connected(conn)
+}
@@ -0,0 +1,190 @@
+package src
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateBurst is how much traffic a bucket holds, in terms of its own rate.
+const rateBurst = time.Second
+
+// minRateRead is the smallest read a throttled source waits for. Without it
+// a source would be read a few bytes at a time as the bucket trickles
+// back, never returning to the event loop.
+const minRateRead = 4096
+
+// RateLimits cap proxied traffic in bytes per second, both directions
+// together; zero disables the corresponding limit.
+type RateLimits struct {
+	Global int64 // all sessions
+	Client int64 // sessions from one client IP
+	User   int64 // sessions of one authenticated user
+}
+
+type tokenBucket struct {
+	key    string // "" for the global bucket
+	refs   int    // sessions sharing the bucket
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(key string, rate int64) *tokenBucket {
+	burst := float64(rate) * rateBurst.Seconds()
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{key: key, rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// need is how many tokens a read waits for, the burst for small rates.
+func (b *tokenBucket) need() float64 {
+	return math.Min(minRateRead, b.burst)
+}
+
+// wait returns how long until need tokens are available.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= b.need() {
+		return 0
+	}
+	return time.Duration((b.need() - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter holds the buckets. It is shared by every event loop, so all
+// bucket state is guarded by mu.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  RateLimits
+	global  *tokenBucket
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(l RateLimits) *rateLimiter {
+	rl := &rateLimiter{limits: l, buckets: make(map[string]*tokenBucket)}
+	if l.Global > 0 {
+		rl.global = newTokenBucket("", l.Global)
+	}
+	return rl
+}
+
+func (s *Server) SetRateLimits(l RateLimits) {
+	s.limiter = newRateLimiter(l)
+}
+
+// update changes the limits for sessions that start proxying from now on.
+// Running sessions keep the buckets they hold.
+func (rl *rateLimiter) update(l RateLimits) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if l.Global != rl.limits.Global {
+		rl.global = nil
+		if l.Global > 0 {
+			rl.global = newTokenBucket("", l.Global)
+		}
+	}
+	if l.Client != rl.limits.Client || l.User != rl.limits.User {
+		rl.buckets = make(map[string]*tokenBucket)
+	}
+	rl.limits = l
+}
+
+// acquire attaches the buckets that apply to conn once it starts
+// proxying. Buckets per client and per user live while a session uses them.
+func (rl *rateLimiter) acquire(conn *Conn) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.global != nil {
+		conn.buckets = append(conn.buckets, rl.global)
+	}
+	if rl.limits.Client > 0 {
+		ip, _ := sockaddrToIP(conn.caddr)
+		conn.buckets = append(conn.buckets, rl.shared("client "+ip.String(), rl.limits.Client))
+	}
+	if rl.limits.User > 0 && conn.user != "" {
+		conn.buckets = append(conn.buckets, rl.shared("user "+conn.user, rl.limits.User))
+	}
+}
+
+func (rl *rateLimiter) shared(key string, rate int64) *tokenBucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = newTokenBucket(key, rate)
+		rl.buckets[key] = b
+	}
+	b.refs++
+	return b
+}
+
+func (rl *rateLimiter) release(conn *Conn) {
+	if len(conn.buckets) == 0 {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, b := range conn.buckets {
+		if b.key == "" {
+			continue
+		}
+		b.refs--
+		if b.refs == 0 && rl.buckets[b.key] == b {
+			// an update may have replaced the bucket under this key
+			delete(rl.buckets, b.key)
+		}
+	}
+	conn.buckets = nil
+}
+
+// allowance returns how many bytes conn may read now and, when that is
+// zero, how long until its slowest bucket lets a read through.
+func (rl *rateLimiter) allowance(conn *Conn, max int) (int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	n := max
+	var wait time.Duration
+	for _, b := range conn.buckets {
+		b.refill(now)
+		if b.tokens < b.need() {
+			// loops reading at the same time can even overdraw a bucket
+			n = 0
+			if w := b.wait(); w > wait {
+				wait = w
+			}
+		} else if int(b.tokens) < n {
+			n = int(b.tokens)
+		}
+	}
+	return n, wait
+}
+
+func (rl *rateLimiter) consume(conn *Conn, n int) {
+	if len(conn.buckets) == 0 {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, b := range conn.buckets {
+		b.tokens -= float64(n)
+	}
+}
+
+// throttle stops reading fd until the buckets refill. Reads are
+// edge-triggered, so the timer restarts relayRead itself.
+func (s *Server) throttle(conn *Conn, fd int, st *stream, wait time.Duration) {
+	st.throttle = s.timers.after(wait, func() {
+		st.throttle = nil
+		if conn.fd > 0 {
+			s.relayRead(conn, fd)
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package src
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// getBuffer returns a read buffer of bufferSize bytes from the pool. What
+// is read into it is copied or written out before it is put back.
+func (s *Server) getBuffer() *[]byte {
+	if b, ok := s.buffers.Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, s.bufferSize)
+	return &b
+}
+
+func (s *Server) putBuffer(b *[]byte) {
+	s.buffers.Put(b)
+}
+
+func isAgain(err error) bool {
+	return errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK)
+}
+
+// route returns the peer of fd and the stream that carries bytes read from fd.
+func (c *Conn) route(fd int) (int, *stream) {
+	if fd == c.fd {
+		return c.rfd, &c.up
+	}
+	return c.fd, &c.down
+}
+
+// inbound returns the source of the stream that is written to fd.
+func (c *Conn) inbound(fd int) (int, *stream) {
+	if fd == c.rfd {
+		return c.fd, &c.up
+	}
+	return c.rfd, &c.down
+}
+
+// relayRead drains fd until EAGAIN, EOF, or until the peer's outbound
+// buffer reaches highWater. Reads are edge-triggered, so a paused stream is
+// resumed explicitly from flush.
+func (s *Server) relayRead(conn *Conn, fd int) {
+	dst, st := conn.route(fd)
+	if st.pipe[0] > 0 {
+		s.spliceRead(conn, fd, dst, st)
+		return
+	}
+	bp := s.getBuffer()
+	defer s.putBuffer(bp)
+	buf := *bp
+	for {
+		if st.eof || st.throttle != nil {
+			return
+		}
+		if len(st.pending) >= s.highWater() {
+			st.paused = true
+			return
+		}
+		limit := len(buf)
+		if len(conn.buckets) > 0 {
+			var wait time.Duration
+			if limit, wait = s.limiter.allowance(conn, limit); limit == 0 {
+				s.throttle(conn, fd, st, wait)
+				return
+			}
+		}
+		n, err := unix.Read(fd, buf[:limit])
+		if err != nil {
+			if !isAgain(err) {
+				s.closeWith(conn, "read error: "+err.Error())
+			}
+			return
+		}
+		conn.lastActive = time.Now()
+		s.account(conn, st, n)
+		s.limiter.consume(conn, n)
+		if n == 0 {
+			st.eof = true
+			s.finish(conn, dst, st)
+			return
+		}
+		if err := s.send(dst, st, buf[:n]); err != nil {
+			s.closeWith(conn, "write error: "+err.Error())
+			return
+		}
+	}
+}
+
+// send writes data to dst, keeping whatever the socket does not accept
+// in st and asking the poller for write readiness.
+func (s *Server) send(dst int, st *stream, data []byte) error {
+	if len(st.pending) > 0 {
+		st.pending = append(st.pending, data...)
+		return nil
+	}
+	n, err := unix.Write(dst, data)
+	if err != nil && !isAgain(err) {
+		return err
+	}
+	if n > 0 {
+		data = data[n:]
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	st.pending = append(st.pending, data...)
+	return s.selecter.Modify(dst, EventRead|EventWrite)
+}
+
+// flush writes pending and piped bytes to fd once it is writable and
+// resumes the source side when there is room again.
+func (s *Server) flush(conn *Conn, fd int) {
+	src, st := conn.inbound(fd)
+	for len(st.pending) > 0 {
+		n, err := unix.Write(fd, st.pending)
+		if n > 0 {
+			st.pending = st.pending[n:]
+			conn.lastActive = time.Now()
+		}
+		if err != nil {
+			if !isAgain(err) {
+				s.closeWith(conn, "write error: "+err.Error())
+				return
+			}
+			break
+		}
+	}
+	if len(st.pending) == 0 && st.piped > 0 {
+		if err := s.drainPipe(fd, st); err != nil {
+			s.closeWith(conn, "splice error: "+err.Error())
+			return
+		}
+	}
+	if len(st.pending) == 0 && st.piped == 0 {
+		st.pending = nil
+		if err := s.selecter.Modify(fd, EventRead); err != nil {
+			s.closeWith(conn, err.Error())
+			return
+		}
+		s.finish(conn, fd, st)
+		if conn.fd == 0 {
+			return
+		}
+	}
+	if st.paused && !s.full(st) {
+		st.paused = false
+		s.relayRead(conn, src)
+	}
+}
+
+// full tells whether st holds as much as its source may read ahead.
+func (s *Server) full(st *stream) bool {
+	if st.pipe[0] > 0 {
+		return st.piped >= st.pipeCap
+	}
+	return len(st.pending) >= s.highWater()
+}
+
+// finish forwards the source's FIN with shutdown(SHUT_WR) once everything
+// read before it has reached dst. The session is released only when both
+// directions are finished.
+func (s *Server) finish(conn *Conn, dst int, st *stream) {
+	if !st.eof || st.shut || len(st.pending) > 0 || st.piped > 0 {
+		return
+	}
+	st.shut = true
+	if err := unix.Shutdown(dst, unix.SHUT_WR); err != nil {
+		s.closeWith(conn, "shutdown: "+err.Error())
+		return
+	}
+	if conn.up.shut && conn.down.shut {
+		s.closeWith(conn, "done")
+	}
+}
@@ -0,0 +1,107 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	REP_SUCCEEDED             = 0x00
+	REP_GENERAL_FAILURE       = 0x01
+	REP_NOT_ALLOWED           = 0x02
+	REP_NETWORK_UNREACHABLE   = 0x03
+	REP_HOST_UNREACHABLE      = 0x04
+	REP_CONNECTION_REFUSED    = 0x05
+	REP_TTL_EXPIRED           = 0x06
+	REP_COMMAND_NOT_SUPPORTED = 0x07
+	REP_ADDRESS_NOT_SUPPORTED = 0x08
+)
+
+// socksError carries the reply code a failed request has to be answered with.
+type socksError struct {
+	rep byte
+	msg string
+}
+
+func (e *socksError) Error() string {
+	return e.msg
+}
+
+func newSocksError(rep byte, format string, args ...any) error {
+	return &socksError{rep: rep, msg: fmt.Sprintf(format, args...)}
+}
+
+// replyCode maps request, socket and resolver errors to RFC 1928 REP codes.
+func replyCode(err error) byte {
+	var serr *socksError
+	if errors.As(err, &serr) {
+		return serr.rep
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound || dnsErr.IsTimeout {
+			return REP_HOST_UNREACHABLE
+		}
+		return REP_GENERAL_FAILURE
+	}
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case unix.ECONNREFUSED:
+			return REP_CONNECTION_REFUSED
+		case unix.ENETUNREACH, unix.ENETDOWN:
+			return REP_NETWORK_UNREACHABLE
+		case unix.EHOSTUNREACH, unix.EHOSTDOWN:
+			return REP_HOST_UNREACHABLE
+		case unix.ETIMEDOUT:
+			return REP_TTL_EXPIRED
+		case unix.EAFNOSUPPORT, unix.EPROTONOSUPPORT:
+			return REP_ADDRESS_NOT_SUPPORTED
+		case unix.EACCES, unix.EPERM:
+			return REP_NOT_ALLOWED
+		}
+	}
+	return REP_GENERAL_FAILURE
+}
+
+// replySucceeded tells the client its request went through, in the
+// client's protocol. A forwarded HTTP request is answered by the origin.
+func (s *Server) replySucceeded(conn *Conn, ip net.IP, port uint16) {
+	switch {
+	case conn.proto == ProtoSOCKS4:
+		s.answerSocks4(SOCKS4_GRANTED, conn.fd, ip, port)
+	case conn.proto != ProtoHTTP:
+		s.answerHello(REP_SUCCEEDED, conn.fd, ip, port, "")
+	case !conn.forward:
+		s.replyHTTP(conn, 200)
+	}
+}
+
+// replyError answers a failed request with the matching REP code and
+// closes the session.
+func (s *Server) replyError(conn *Conn, err error) {
+	if conn.fd <= 0 {
+		return
+	}
+	rep := replyCode(err)
+	fmt.Printf("Request %s failed (reply 0x%02x): %v\n", net.JoinHostPort(conn.host, fmt.Sprint(conn.port)), rep, err)
+	switch conn.proto {
+	case ProtoHTTP:
+		s.replyHTTP(conn, httpStatus(err))
+	case ProtoSOCKS4:
+		s.answerSocks4(socks4Code(err), conn.fd, nil, 0)
+	default:
+		s.answerHello(rep, conn.fd, nil, 0, "")
+	}
+	switch {
+	case rep == REP_NOT_ALLOWED || httpStatus(err) == 407:
+		s.metrics.rejected.Add(1)
+	case !conn.dialed.IsZero() && err != errShuttingDown:
+		s.metrics.connectErrors.Add(1)
+	}
+	conn.rep = rep
+	s.closeWith(conn, err.Error())
+}
@@ -0,0 +1,369 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	resolvConf = "/etc/resolv.conf"
+	hostsFile  = "/etc/hosts"
+	dnsPort    = 53
+
+	defaultDNSTimeout  = 5 * time.Second
+	defaultDNSAttempts = 2
+	maxDNSMessage      = 4096
+)
+
+// dnsQuery is one outstanding question on the resolver socket.
+type dnsQuery struct {
+	id       uint16
+	qtype    uint16
+	msg      []byte
+	server   int
+	attempt  int
+	deadline time.Time
+	lookup   *dnsLookup
+}
+
+// dnsLookup collects the A and AAAA queries made for one name.
+type dnsLookup struct {
+	name     string
+	key      string
+	pending  int
+	ips4     []net.IP
+	ips6     []net.IP
+	ttl      uint32
+	err      error
+	nxdomain bool
+	done     func(ips []net.IP, err error)
+}
+
+// resolver is a non-blocking stub resolver driven by the server event loop:
+// its socket is registered with the poller and retries are handled from
+// WaitEvents through timeout and expire.
+type resolver struct {
+	fd          int
+	family      int
+	nameservers []net.IP
+	timeout     time.Duration
+	attempts    int
+	hosts       map[string][]net.IP
+	queries     map[uint16]*dnsQuery
+	cache       *dnsCache
+	metrics     *metrics
+}
+
+func newResolver(selecter Poller) (*resolver, error) {
+	r := &resolver{
+		timeout:  defaultDNSTimeout,
+		attempts: defaultDNSAttempts,
+		queries:  make(map[uint16]*dnsQuery),
+		hosts:    loadHosts(hostsFile),
+		cache:    newDNSCache(dnsCacheSize),
+	}
+
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, 0)
+	r.family = unix.AF_INET6
+	if err == nil {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+		if err != nil {
+			unix.Close(fd)
+		}
+	}
+	if err != nil {
+		fd, err = unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+		r.family = unix.AF_INET
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err = selecter.Add(fd, EventRead); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	r.fd = fd
+
+	if err := r.loadResolvConf(resolvConf); err != nil {
+		fmt.Printf("Failed read %s: %v; using 127.0.0.1\n", resolvConf, err)
+	}
+	if len(r.nameservers) == 0 {
+		r.nameservers = []net.IP{net.ParseIP(localhost)}
+	}
+	return r, nil
+}
+
+func (r *resolver) loadResolvConf(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				if r.family == unix.AF_INET && ip.To4() == nil {
+					continue
+				}
+				r.nameservers = append(r.nameservers, ip)
+			}
+		case "options":
+			for _, opt := range fields[1:] {
+				name, value, _ := strings.Cut(opt, ":")
+				n, err := strconv.Atoi(value)
+				if err != nil || n <= 0 {
+					continue
+				}
+				switch name {
+				case "timeout":
+					r.timeout = time.Duration(n) * time.Second
+				case "attempts":
+					r.attempts = n
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func loadHosts(path string) map[string][]net.IP {
+	hosts := make(map[string][]net.IP)
+	file, err := os.Open(path)
+	if err != nil {
+		return hosts
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts
+}
+
+// lookup resolves name to its IPv4 addresses followed by its IPv6 ones and
+// calls done from the event loop. done may run before lookup returns when
+// the answer is known locally.
+func (r *resolver) lookup(name string, done func(ips []net.IP, err error)) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	r.metrics.dnsLookups.Add(1)
+	if ips, ok := r.hosts[key]; ok {
+		done(ips, nil)
+		return
+	}
+	if ips, err, ok := r.cache.get(key); ok {
+		r.metrics.dnsCacheHits.Add(1)
+		done(ips, err)
+		return
+	}
+
+	l := &dnsLookup{name: name, key: key, done: done}
+	for _, qtype := range []uint16{DNS_TYPE_A, DNS_TYPE_AAAA} {
+		if err := r.query(l, qtype); err != nil {
+			l.err = err
+			continue
+		}
+		l.pending++
+	}
+	if l.pending == 0 {
+		r.complete(l)
+	}
+}
+
+func (r *resolver) newID() uint16 {
+	for {
+		id := uint16(rand.Uint32())
+		if _, busy := r.queries[id]; !busy {
+			return id
+		}
+	}
+}
+
+func (r *resolver) query(l *dnsLookup, qtype uint16) error {
+	id := r.newID()
+	msg, err := buildQuery(id, l.name, qtype)
+	if err != nil {
+		return &net.DNSError{Err: err.Error(), Name: l.name, IsNotFound: true}
+	}
+	q := &dnsQuery{id: id, qtype: qtype, msg: msg, lookup: l}
+	r.queries[id] = q
+	r.send(q)
+	return nil
+}
+
+func (r *resolver) send(q *dnsQuery) {
+	q.server = q.attempt % len(r.nameservers)
+	q.deadline = time.Now().Add(r.timeout)
+	sa, err := ipToSockaddrFamily(r.family, r.nameservers[q.server], dnsPort)
+	if err != nil {
+		return
+	}
+	// a lost send is recovered by the retry timer
+	_ = unix.Sendto(r.fd, q.msg, 0, sa)
+}
+
+// handleRead consumes every datagram waiting on the resolver socket.
+func (r *resolver) handleRead() {
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, from, err := unix.Recvfrom(r.fd, buf, 0)
+		if err != nil {
+			if !isAgain(err) {
+				fmt.Printf("DNS recvfrom: %v\n", err)
+			}
+			return
+		}
+		r.handleAnswer(buf[:n], from)
+	}
+}
+
+func (r *resolver) handleAnswer(msg []byte, from unix.Sockaddr) {
+	if len(msg) < DNS_HEADER_LEN {
+		return
+	}
+	id := uint16(msg[0])<<8 | uint16(msg[1])
+	q, ok := r.queries[id]
+	if !ok {
+		return
+	}
+	ip, port := sockaddrToIP(from)
+	if port != dnsPort || !ip.Equal(r.nameservers[q.server]) {
+		return
+	}
+	question := q.msg[DNS_HEADER_LEN:]
+	if len(msg) < DNS_HEADER_LEN+len(question) || !bytes.EqualFold(msg[DNS_HEADER_LEN:DNS_HEADER_LEN+len(question)], question) {
+		return
+	}
+	ans, err := parseAnswer(msg, q.qtype)
+	if err != nil {
+		return
+	}
+
+	delete(r.queries, id)
+	l := q.lookup
+	l.pending--
+	switch ans.rcode {
+	case DNS_RCODE_NOERROR:
+		if len(ans.ips) > 0 {
+			if l.ips4 == nil && l.ips6 == nil || ans.ttl < l.ttl {
+				l.ttl = ans.ttl
+			}
+			if q.qtype == DNS_TYPE_A {
+				l.ips4 = ans.ips
+			} else {
+				l.ips6 = ans.ips
+			}
+		} else if l.err == nil {
+			l.err = &net.DNSError{Err: "no such host", Name: l.name, IsNotFound: true}
+		}
+	case DNS_RCODE_NXDOMAIN:
+		l.err = &net.DNSError{Err: "no such host", Name: l.name, IsNotFound: true}
+		l.nxdomain = true
+	default:
+		if l.err == nil {
+			l.err = &net.DNSError{Err: fmt.Sprintf("server failure (rcode %d)", ans.rcode), Name: l.name}
+		}
+	}
+	if l.pending == 0 {
+		r.complete(l)
+	}
+}
+
+func (r *resolver) complete(l *dnsLookup) {
+	ips := append(append([]net.IP(nil), l.ips4...), l.ips6...)
+	if len(ips) > 0 {
+		r.cache.put(l.key, ips, nil, time.Duration(l.ttl)*time.Second)
+		l.done(ips, nil)
+		return
+	}
+	err := l.err
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: l.name, IsNotFound: true}
+	}
+	if l.nxdomain {
+		r.cache.put(l.key, nil, err, dnsNegativeTTL)
+	}
+	l.done(nil, err)
+}
+
+// nextTimeout returns the poller timeout in milliseconds until the nearest
+// retry, or -1 when nothing is outstanding.
+func (r *resolver) nextTimeout() int {
+	if len(r.queries) == 0 {
+		return -1
+	}
+	var nearest time.Time
+	for _, q := range r.queries {
+		if nearest.IsZero() || q.deadline.Before(nearest) {
+			nearest = q.deadline
+		}
+	}
+	ms := time.Until(nearest).Milliseconds()
+	if ms < 0 {
+		return 0
+	}
+	return int(ms) + 1
+}
+
+// expire retransmits queries whose deadline passed, moving to the next
+// nameserver, and fails them once every attempt is used.
+func (r *resolver) expire() {
+	now := time.Now()
+	for id, q := range r.queries {
+		if now.Before(q.deadline) {
+			continue
+		}
+		q.attempt++
+		if q.attempt < r.attempts*len(r.nameservers) {
+			r.send(q)
+			continue
+		}
+		delete(r.queries, id)
+		l := q.lookup
+		l.pending--
+		if l.err == nil {
+			l.err = &net.DNSError{Err: "i/o timeout", Name: l.name, IsTimeout: true}
+		}
+		if l.pending == 0 {
+			r.complete(l)
+		}
+	}
+}
+
+func (r *resolver) Close() {
+	if r.fd > 0 {
+		unix.Close(r.fd)
+	}
+}
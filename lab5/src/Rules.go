@@ -0,0 +1,249 @@
+package src
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type portRange struct {
+	lo, hi uint16
+}
+
+// rule is one line of the rules file:
+//
+//	allow|deny <client CIDR|*> <destination CIDR|domain pattern|*> <ports|*> [via <upstream>]
+//
+// Domain patterns use shell wildcards, "*.example.com" matches every
+// subdomain. Ports are a comma separated list of numbers and ranges. An
+// allow rule may name an upstream proxy, socks5://host:port or
+// http://host:port, that matching sessions are chained through.
+type rule struct {
+	allow     bool
+	client    *net.IPNet
+	dstNet    *net.IPNet
+	dstDomain string
+	ports     []portRange
+	via       *upstream
+	line      int
+}
+
+type ruleSet struct {
+	path  string
+	rules []rule
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// looksLikeAddress tells an address or CIDR from a domain pattern: it has a
+// "/" or ":", or is made only of digits and dots.
+func looksLikeAddress(s string) bool {
+	return strings.ContainsAny(s, "/:") || strings.Trim(s, "0123456789.") == ""
+}
+
+func parsePorts(s string) ([]portRange, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	var ports []portRange
+	for _, part := range strings.Split(s, ",") {
+		loStr, hiStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hiStr = loStr
+		}
+		lo, err := strconv.ParseUint(loStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		hi, err := strconv.ParseUint(hiStr, 10, 16)
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ports = append(ports, portRange{uint16(lo), uint16(hi)})
+	}
+	return ports, nil
+}
+
+func loadRules(file string) (*ruleSet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs := &ruleSet{path: file}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 && (len(fields) != 6 || strings.ToLower(fields[4]) != "via") {
+			return nil, fmt.Errorf("%s:%d: expected <allow|deny> <client> <destination> <ports> [via <upstream>]", file, line)
+		}
+		r := rule{line: line}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			r.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", file, line, fields[0])
+		}
+		if fields[1] != "*" {
+			if r.client, err = parseCIDR(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+		}
+		if fields[2] != "*" {
+			if n, err := parseCIDR(fields[2]); err == nil {
+				r.dstNet = n
+			} else if looksLikeAddress(fields[2]) {
+				// a mistyped address must not become a pattern that never matches
+				return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			} else if _, err := path.Match(fields[2], ""); err == nil {
+				r.dstDomain = strings.ToLower(strings.TrimSuffix(fields[2], "."))
+			} else {
+				return nil, fmt.Errorf("%s:%d: invalid destination %q", file, line, fields[2])
+			}
+		}
+		if r.ports, err = parsePorts(fields[3]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		if len(fields) == 6 {
+			if !r.allow {
+				return nil, fmt.Errorf("%s:%d: only allow rules can name an upstream", file, line)
+			}
+			if r.via, err = parseUpstream(fields[5]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (r *rule) matchPort(port uint16) bool {
+	if r.ports == nil {
+		return true
+	}
+	for _, p := range r.ports {
+		if port >= p.lo && port <= p.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// check evaluates the rules top to bottom, first match wins and nothing
+// matching means deny. dst may be nil before the domain is resolved; the
+// answer is then undecided as soon as a CIDR destination rule is reached.
+func (rs *ruleSet) check(client net.IP, domain string, dst net.IP, port uint16) (allow bool, decided bool) {
+	r, decided := rs.match(client, domain, dst, port)
+	return r != nil && r.allow, decided
+}
+
+// match returns the first rule matching the request, nil when none does.
+func (rs *ruleSet) match(client net.IP, domain string, dst net.IP, port uint16) (*rule, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.client != nil && !r.client.Contains(client) {
+			continue
+		}
+		if !r.matchPort(port) {
+			continue
+		}
+		if r.dstNet != nil {
+			if dst == nil {
+				return nil, false
+			}
+			if !r.dstNet.Contains(dst) {
+				continue
+			}
+		}
+		if r.dstDomain != "" {
+			if ok, _ := path.Match(r.dstDomain, domain); !ok || domain == "" {
+				continue
+			}
+		}
+		return r, true
+	}
+	return nil, true
+}
+
+func (s *Server) LoadRules(file string) error {
+	rs, err := loadRules(file)
+	if err != nil {
+		return err
+	}
+	s.rules = rs
+	return nil
+}
+
+// reloadRules re-reads the rules file on SIGHUP. Established sessions are
+// not re-checked, and a broken file keeps the previous rules.
+func (s *Server) reloadRules() {
+	if s.rules == nil {
+		return
+	}
+	rs, err := loadRules(s.rules.path)
+	if err != nil {
+		fmt.Printf("Failed reload rules: %v; keeping %d old rules\n", err, len(s.rules.rules))
+		return
+	}
+	s.rules = rs
+	fmt.Printf("Reloaded %d rules from %s\n", len(rs.rules), rs.path)
+}
+
+func (s *Server) allowed(conn *Conn, domain string, dst net.IP, port uint16) (bool, bool) {
+	if s.rules == nil {
+		return true, true
+	}
+	client, _ := sockaddrToIP(conn.caddr)
+	return s.rules.check(client, domain, dst, port)
+}
+
+// checkDestination rejects a request whose destination is denied before
+// any resolution happens.
+func (s *Server) checkDestination(conn *Conn, dst net.IP) error {
+	if allow, decided := s.allowed(conn, conn.domain, dst, conn.port); decided && !allow {
+		return newSocksError(REP_NOT_ALLOWED, "connection to %s not allowed by ruleset", net.JoinHostPort(conn.host, fmt.Sprint(conn.port)))
+	}
+	return nil
+}
+
+// filterAddrs keeps the resolved addresses the rules allow for conn.
+func (s *Server) filterAddrs(conn *Conn, addrs []net.IP) []net.IP {
+	var out []net.IP
+	for _, ip := range addrs {
+		if allow, _ := s.allowed(conn, conn.domain, ip, conn.port); allow {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
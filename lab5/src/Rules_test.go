@@ -0,0 +1,94 @@
+package src
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRules(t *testing.T, lines ...string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "rules")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadRulesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"prefix too long", "deny * 127.0.0.1/33 *"},
+		{"short IPv4", "deny * 10.0.1 *"},
+		{"bad IPv6", "deny * fe80::zz *"},
+		{"bad client", "allow 10.0.0.0/40 * *"},
+		{"bad action", "permit * * *"},
+		{"bad port", "allow * * 80-"},
+		{"reversed range", "allow * * 90-80"},
+		{"bad domain pattern", "allow * [example.com *"},
+		{"missing field", "allow * *"},
+		{"deny via upstream", "deny * * * via socks5://127.0.0.1:1080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadRules(writeRules(t, tt.line)); err == nil {
+				t.Errorf("loadRules(%q) succeeded, want an error", tt.line)
+			}
+		})
+	}
+}
+
+func TestRulesMatch(t *testing.T) {
+	rs, err := loadRules(writeRules(t,
+		"# comments and blank lines are skipped",
+		"",
+		"deny  *            10.0.0.0/8      *",
+		"allow 192.168.1.0/24 *             22",
+		"deny  *            *               22",
+		"allow *            *.example.com   443,8000-8080",
+		"deny  *            bad.example.com *",
+		"allow *            ::1             *",
+		"allow *            127.0.0.1       80",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		client  string
+		domain  string
+		dst     string
+		port    uint16
+		allow   bool
+		decided bool
+	}{
+		{"CIDR deny", "127.0.0.1", "", "10.1.2.3", 80, false, true},
+		{"client CIDR allow", "192.168.1.7", "", "8.8.8.8", 22, true, true},
+		{"client outside CIDR", "192.168.2.7", "", "8.8.8.8", 22, false, true},
+		{"wildcard domain", "127.0.0.1", "www.example.com", "93.184.216.34", 443, true, true},
+		{"wildcard domain is case-insensitive", "127.0.0.1", "WWW.Example.COM.", "93.184.216.34", 443, true, true},
+		{"wildcard needs a subdomain", "127.0.0.1", "example.com", "93.184.216.34", 443, false, true},
+		{"port range low end", "127.0.0.1", "a.example.com", "93.184.216.34", 8000, true, true},
+		{"port range high end", "127.0.0.1", "a.example.com", "93.184.216.34", 8080, true, true},
+		{"outside port range", "127.0.0.1", "a.example.com", "93.184.216.34", 8081, false, true},
+		{"first match wins", "127.0.0.1", "bad.example.com", "93.184.216.34", 443, true, true},
+		{"later rule when the first misses", "127.0.0.1", "bad.example.com", "93.184.216.34", 80, false, true},
+		{"IPv6 destination", "::1", "", "::1", 9999, true, true},
+		{"single address and port", "127.0.0.1", "", "127.0.0.1", 80, true, true},
+		{"default deny", "127.0.0.1", "", "127.0.0.1", 81, false, true},
+		{"CIDR rule needs the address", "127.0.0.1", "host.test", "", 80, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, decided := rs.check(net.ParseIP(tt.client), tt.domain, net.ParseIP(tt.dst), tt.port)
+			if allow != tt.allow || decided != tt.decided {
+				t.Errorf("check(%s, %q, %s, %d) = %v, %v; want %v, %v",
+					tt.client, tt.domain, tt.dst, tt.port, allow, decided, tt.allow, tt.decided)
+			}
+		})
+	}
+}
@@ -2,11 +2,12 @@ package src
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -22,18 +23,6 @@ const (
 
 const (
 	MIN_COUNT_AUTH = 1
-	MIN_LEN_REQUEST = 7
-	MIN_LEN_REQ_DOMAIN = 10
-
-	START_BYTE_IP = 4
-	FINISH_BYTE_IP = 8
-
-	START_BYTE_PORT = 8
-	FINISH_BYTE_PORT = 10
-
-	INDEX_LEN_DOMAIN = 4
-
-	START_DOMAIN_BYTE = 5
 	PORT_LEN = 2
 )
 
@@ -45,22 +34,81 @@ const (
 
 
 type Server struct {
-	listenFD    int
-	selecter    int
+	listeners   []int
+	selecter    Poller
 	IP          string
 	connections map[int]*Conn
-	mu          sync.Mutex
+	users       map[string]string
+	resolver    *resolver
+	signalFD    int
+	timers      *timerWheel
+	timeouts    Timeouts
+	rules       *ruleSet
+	accessLog   *accessLog
+	limiter     *rateLimiter
+	metrics     *metrics
+	backlog     int
+	bufferSize  int
+	buffers     sync.Pool // read buffers of bufferSize bytes
+	splice      bool
+	reusePort   bool
+	draining    bool
+	drain       time.Duration // how long shutdown waits for proxied sessions
+	loops       []*Server     // every event loop of the process, for admin commands
+	inboxMu     sync.Mutex
+	inbox       []func()      // work other loops hand to this one
+	stopped     bool          // the loop has left WaitEvents, guarded by inboxMu
+	wakeFD      int           // write end of the signal pipe
+	signals     chan os.Signal
+	signalsDone chan struct{} // closed when the forwarding goroutine exits
+	adminPath   string
+	adminFD     int
+	admins      map[int]*adminClient
 }
 
 func NewServer() *Server {
 	return &Server{
-		listenFD:    0,
-		selecter:    0,
+		selecter:    nil,
 		connections: make(map[int]*Conn),
+		limiter:     newRateLimiter(RateLimits{}),
+		metrics:     newMetrics(),
+		backlog:     countClient,
+		bufferSize:  bufsize,
+		timers:      newTimerWheel(),
+		timeouts: Timeouts{
+			Handshake: defaultHandshakeTimeout,
+			Connect:   defaultConnectTimeout,
+			Idle:      defaultIdleTimeout,
+		},
+		drain:       defaultDrainTimeout,
 	}
 }
 
-func getInterface(name string) (string, error) {
+// listenAddr is an address a listener is bound to. An optional address
+// is skipped with a message when it cannot be bound.
+type listenAddr struct {
+	ip       net.IP
+	port     int
+	optional bool
+}
+
+func (a listenAddr) String() string {
+	return net.JoinHostPort(a.ip.String(), fmt.Sprint(a.port))
+}
+
+// SetBuffers sets the listen backlog and the size of relay reads.
+func (s *Server) SetBuffers(backlog, size int) {
+	s.backlog = backlog
+	s.bufferSize = size
+}
+
+// highWater is how many bytes may wait for the destination before reads
+// from the source side are paused.
+func (s *Server) highWater() int {
+	return 4 * s.bufferSize
+}
+
+func getInterface(name string, ipv6 bool) (string, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return "", err
@@ -76,96 +124,162 @@ func getInterface(name string) (string, error) {
 				if !ok || ipnet.IP.IsLoopback() {
 					continue
 				}
-				if ipnet.IP.To4() != nil {
+				if !ipv6 && ipnet.IP.To4() != nil {
+					return ipnet.IP.String(), nil
+				}
+				if ipv6 && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
 					return ipnet.IP.String(), nil
 				}
 			}
 		}
 	}
+	if ipv6 {
+		return "", fmt.Errorf("interface %s not found or has no global IPv6 address", name)
+	}
 	return "", fmt.Errorf("interface %s not found or has no IPv4 address", name)
 }
 
-func (s *Server) InitSocket(port int) {
-	ifaceIP, err := getInterface("en0")
+func listenOn(ip net.IP, port, backlog int, reusePort bool) (int, error) {
+	addr, err := ipToSockaddr(ip, uint16(port))
 	if err != nil {
-		fmt.Printf("getInterface failed: %v; falling back to localhost\n", err)
-		ifaceIP = localhost
+		return -1, err
 	}
-
-	s.listenFD, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	fd, err := unix.Socket(socketFamily(ip), unix.SOCK_STREAM, 0)
 	if err != nil {
-		fmt.Println("Failed init tcp socket")
-		panic(err)
+		return -1, err
+	}
+	if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	if reusePort {
+		// every event loop binds its own listener, the kernel spreads
+		// incoming connections between them
+		if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
 	}
-
-	addr := &unix.SockaddrInet4{Port: port}
-
-	ip := net.ParseIP(ifaceIP)
-	if ip == nil {
-		panic(fmt.Errorf("invalid IP address: %s", ifaceIP))
-	} else {
-		ip4 := ip.To4()
-		if ip4 == nil {
-			panic(fmt.Errorf("not an IPv4 address: %s", ifaceIP))
+	if socketFamily(ip) == unix.AF_INET6 {
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1); err != nil {
+			unix.Close(fd)
+			return -1, err
 		}
-		copy(addr.Addr[:], ip4)
 	}
+	if err = unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	if err = unix.Listen(fd, backlog); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
 
+// defaultAddrs listens on every address, IPv4 and, where the host has it,
+// IPv6.
+func defaultAddrs(port int) []listenAddr {
+	return []listenAddr{
+		{ip: net.IPv4zero, port: port},
+		{ip: net.IPv6unspecified, port: port, optional: true},
+	}
+}
 
-	err = unix.SetsockoptInt(s.listenFD, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
-
-	 if err != nil {
-        unix.Close(s.listenFD)
-        panic(err)
-    }
-
-	if err = unix.Bind(s.listenFD, addr); err != nil {
-		fmt.Println("Failed bind")
-		panic(err)
+// interfaceAddrs returns the addresses of the named interface to listen on
+// at port: its IPv4 address and, if it has one, a global IPv6 address.
+func interfaceAddrs(name string, port int) ([]listenAddr, error) {
+	ifaceIP, err := getInterface(name, false)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []listenAddr{{ip: net.ParseIP(ifaceIP), port: port}}
+	if ifaceIP6, err := getInterface(name, true); err == nil {
+		addrs = append(addrs, listenAddr{ip: net.ParseIP(ifaceIP6), port: port})
 	}
+	return addrs, nil
+}
 
-	if err = unix.Listen(s.listenFD, countClient); err != nil {
-		panic(err)
+func (s *Server) InitSocket(addrs []listenAddr) error {
+	for _, a := range addrs {
+		fd, err := listenOn(a.ip, a.port, s.backlog, s.reusePort)
+		if err != nil {
+			if a.optional {
+				fmt.Printf("Listener %s disabled: %v\n", a, err)
+				continue
+			}
+			s.closeListeners()
+			return fmt.Errorf("bind %s: %v", a, err)
+		}
+		s.listeners = append(s.listeners, fd)
+		if s.IP == "" {
+			s.IP = a.ip.String()
+		}
+		fmt.Printf("Listening on %s\n", a)
 	}
+	return nil
+}
 
-	if err = unix.SetNonblock(s.listenFD, true); err != nil {
-		panic(err)
+func (s *Server) closeListeners() {
+	for _, fd := range s.listeners {
+		unix.Close(fd)
 	}
+	s.listeners = nil
+}
 
-	s.IP = ifaceIP
-	fmt.Printf("Listening on %s:%d\n", ifaceIP, port)
+func (s *Server) isListener(fd int) bool {
+	for _, l := range s.listeners {
+		if l == fd {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *Server) InitSelecter() {
+func (s *Server) InitSelecter() error {
 	var err error
-	s.selecter, err = unix.Kqueue()
+	s.selecter, err = newPoller()
+	if err != nil {
+		return err
+	}
+
+	for _, fd := range s.listeners {
+		if err := s.selecter.Add(fd, EventRead); err != nil {
+			return err
+		}
+	}
+
+	s.resolver, err = newResolver(s.selecter)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	s.resolver.metrics = s.metrics
 
-	change := unix.Kevent_t{
-		Ident:  uint64(s.listenFD),
-		Filter: unix.EVFILT_READ,
-		Flags:  unix.EV_ADD | unix.EV_CLEAR,
+	if err = s.initSignals(); err != nil {
+		return err
 	}
-	if _, err := unix.Kevent(s.selecter, []unix.Kevent_t{change}, nil, nil); err != nil {
-		panic(err)
+	if s.adminPath != "" {
+		return s.initAdmin()
 	}
+	return nil
 }
 
 func (s *Server) newConnection(listenFD int) error {
-	connFD, _, err := unix.Accept(listenFD)
+	connFD, sa, err := unix.Accept(listenFD)
 	if err != nil {
 		return err
 	}
 	_ = unix.SetNonblock(connFD, true)
+	laddr, _ := unix.Getsockname(connFD)
 
-	change := unix.Kevent_t{
-		Ident:  uint64(connFD),
-		Filter: unix.EVFILT_READ,
-		Flags:  unix.EV_ADD | unix.EV_CLEAR,
+	if err := s.selecter.Add(connFD, EventRead); err != nil {
+		unix.Close(connFD)
+		return err
 	}
-	unix.Kevent(s.selecter, []unix.Kevent_t{change}, nil, nil)
 
 	c := &Conn{
 		fd:       connFD,
@@ -174,148 +288,295 @@ func (s *Server) newConnection(listenFD int) error {
 		host:     "",
 		domain:   "",
 		resolving: false,
+		caddr:    sa,
+		laddr:    laddr,
+		started:  time.Now(),
 	}
 
-	s.mu.Lock()
 	s.connections[connFD] = c
-	s.mu.Unlock()
+	s.metrics.accepted.Add(1)
+	s.metrics.states[StateHello].Add(1)
+	s.setState(c, StateHello)
 	return nil
 }
 
-func (s *Server) readFD(fd int, conn *Conn) ([]byte, error, int) {
-	buf := make([]byte, bufsize)
-	n, err := unix.Read(fd, buf)
-	if n == 0 || (err != nil && errors.Is(err, unix.ECONNRESET)) {
-		s.closeConn(conn)
-		return nil, err, 0
-	}
-	if err != nil {
-		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
-			return nil, err, 0
+// readInput drains the client socket outside of StateProxy. Bytes are
+// accumulated in conn.in and consumed message by message, so a greeting
+// split across segments or a request pipelined with payload both work.
+func (s *Server) readInput(conn *Conn) {
+	bp := s.getBuffer()
+	defer s.putBuffer(bp)
+	buf := *bp
+	for conn.fd > 0 {
+		if len(conn.in) >= s.highWater() {
+			conn.up.paused = true
+			return
+		}
+		n, err := unix.Read(conn.fd, buf)
+		if err != nil {
+			if !isAgain(err) {
+				s.closeWith(conn, "read error: "+err.Error())
+			}
+			return
+		}
+		if n == 0 {
+			if conn.state == StateConnecting || conn.state == StateBinding || conn.upstreamPhase() {
+				// forwarded once the upstream side exists
+				conn.up.eof = true
+				return
+			}
+			if conn.state == StateAssociate {
+				s.closeWith(conn, "client closed")
+			} else {
+				s.closeWith(conn, "client closed during handshake")
+			}
+			return
+		}
+		conn.lastActive = time.Now()
+		if conn.state == StateAssociate {
+			// the control connection carries no data
+			continue
+		}
+		conn.in = append(conn.in, buf[:n]...)
+		if err := s.handleRequest(conn); err != nil {
+			return
 		}
-		s.closeConn(conn)
-		return nil, err, 0
 	}
-	return buf, nil, n
 }
 
-func (s *Server) handleRequest(fd int, conn *Conn, buf []byte, n int) error {
-	if conn.state == StateHello {
-		s.processHello(fd, buf[:n])
-		conn.state = StateRequest
-		s.mu.Lock()
-		s.connections[fd] = conn
-		s.mu.Unlock()
-	} else if conn.state == StateRequest {
-		s.processRequest(conn, buf[:n])
-		s.connectToHost(conn)
-		s.mu.Lock()
-		s.connections[fd] = conn
-		s.mu.Unlock()
-	} else if conn.state == StateProxy {
-		if fd == conn.fd {
-			if conn.rfd <= 0 {
-				return errors.New("remote fd <= 0")
+// handleRequest consumes complete handshake messages from conn.in. Bytes
+// left after the request stay there until the upstream is connected.
+func (s *Server) handleRequest(conn *Conn) error {
+	for conn.fd > 0 && len(conn.in) > 0 {
+		var n int
+		var err error
+		request := conn.state == StateRequest || conn.state == StateHTTPRequest
+		switch conn.state {
+		case StateHello:
+			n, err = s.processHello(conn, conn.in)
+		case StateAuth:
+			n, err = s.processAuth(conn, conn.in)
+		case StateRequest:
+			n, err = s.processRequest(conn, conn.in)
+		case StateHTTPRequest:
+			n, err = s.processHTTPRequest(conn, conn.in)
+		default:
+			return nil
+		}
+		if err == errIncomplete {
+			limit := maxHandshakeLen
+			if conn.state == StateHTTPRequest {
+				limit = maxHTTPHeadLen
 			}
-			if err := writeFull(conn.rfd, buf[:n]); err != nil {
-				s.closeConn(conn)
+			if len(conn.in) <= limit {
+				return nil
 			}
-		} else if conn.rfd == fd {
-			if conn.fd <= 0 {
-				return errors.New("client fd <= 0")
+			if conn.proto == ProtoHTTP {
+				err = newHTTPError(431, "request header too long")
+			} else {
+				err = errors.New("handshake message too long")
 			}
-			if err := writeFull(conn.fd, buf[:n]); err != nil {
-				s.closeConn(conn)
+		}
+		if err != nil {
+			if request {
+				s.replyError(conn, err)
+			} else {
+				fmt.Println(err)
+				s.closeWith(conn, err.Error())
+			}
+			return err
+		}
+		conn.in = conn.in[n:]
+
+		if request {
+			s.metrics.handshake.observe(time.Since(conn.started))
+			switch conn.cmd {
+			case CMD_UDP_ASSOCIATE:
+				err = s.startAssociate(conn)
+			case CMD_BIND:
+				err = s.startBind(conn)
+			default:
+				err = s.connectToHost(conn)
+			}
+			if err != nil {
+				s.replyError(conn, err)
+				return err
 			}
 		}
 	}
+	if len(conn.in) == 0 {
+		conn.in = nil
+	}
 	return nil
 }
 
+// WaitEvents runs the event loop until a shutdown has drained every session.
 func (s *Server) WaitEvents() {
-	events := make([]unix.Kevent_t, countClient)
-	for {
-		count, err := unix.Kevent(s.selecter, nil, events, nil)
+	events := make([]Event, countClient)
+	for !s.drained() {
+		timeout := minTimeout(s.resolver.nextTimeout(), s.timers.nextTimeout())
+		count, err := s.selecter.Wait(events, timeout)
 		if err != nil {
 			if err == unix.EINTR {
 				continue
 			}
 			panic(err)
 		}
+		s.resolver.expire()
+		s.timers.advance()
 		for i := 0; i < count; i++ {
-			fd := int(events[i].Ident)
-			filter := events[i].Filter
-
-			if fd == s.listenFD && filter == unix.EVFILT_READ {
-				_ = s.newConnection(fd)
+			fd := events[i].Fd
+
+			if s.isListener(fd) && events[i].Readable {
+				// edge-triggered: take the whole accept queue
+				for {
+					if err := s.newConnection(fd); err != nil {
+						if !isAgain(err) {
+							fmt.Printf("Accept failed: %v\n", err)
+						}
+						break
+					}
+				}
+				continue
+			}
+			if fd == s.resolver.fd {
+				s.resolver.handleRead()
+				continue
+			}
+			if fd == s.signalFD {
+				s.handleSignals()
+				continue
+			}
+			if fd == s.adminFD {
+				s.acceptAdmin()
+				continue
+			}
+			if a, ok := s.admins[fd]; ok {
+				s.handleAdmin(a, events[i])
 				continue
 			}
 
-			if filter == unix.EVFILT_READ {
-				s.mu.Lock()
-				conn, ok := s.connections[fd]
-				s.mu.Unlock()
-				if !ok {
-					unix.Close(fd)
-					continue
-				}
-
-				buf, err, n := s.readFD(fd, conn)
-				if err != nil {
-					if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
-						continue
-					}
-					continue
-				}
-				if n == 0 || buf == nil {
-					continue
-				}
+			if events[i].Readable {
+				s.handleRead(fd)
+			}
+			if events[i].Writable {
+				s.handleWrite(fd)
+			}
+		}
+	}
+	s.stopInbox()
+}
 
-				_ = s.handleRequest(fd, conn, buf, n)
-			} else if filter == unix.EVFILT_WRITE {
-				s.mu.Lock()
-				conn, ok := s.connections[fd]
-				s.mu.Unlock()
-				if !ok {
-					continue
-				}
-				if conn.state == StateConnecting && fd == conn.rfd {
-					serr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
-					if err != nil || serr != 0 {
-						s.closeConn(conn)
-						continue
-					}
+func (s *Server) handleRead(fd int) {
+	conn, ok := s.connections[fd]
+	if !ok {
+		// a stale event for an fd closed earlier in this batch; the number
+		// may already belong to another loop, so it must not be closed
+		return
+	}
 
-					s.answerHello(ZERO, conn.fd, nil, 0, "")
-					conn.state = StateProxy
+	if fd == conn.ufd {
+		s.relayUDP(conn)
+		return
+	}
+	if fd == conn.lfd {
+		s.acceptBind(conn)
+		return
+	}
+	if conn.state == StateConnecting && conn.isAttempt(fd) {
+		// connect result is reported through the write event
+		return
+	}
+	if fd == conn.rfd && conn.upstreamPhase() {
+		s.readUpstream(conn)
+		return
+	}
+	if conn.state == StateProxy {
+		s.relayRead(conn, fd)
+		return
+	}
+	if fd == conn.fd {
+		s.readInput(conn)
+	}
+}
 
-					change := unix.Kevent_t{
-						Ident:  uint64(conn.rfd),
-						Filter: unix.EVFILT_READ,
-						Flags:  unix.EV_ADD | unix.EV_CLEAR,
-					}
-					unix.Kevent(s.selecter, []unix.Kevent_t{change}, nil, nil)
+func (s *Server) handleWrite(fd int) {
+	conn, ok := s.connections[fd]
+	if !ok {
+		return
+	}
+	if conn.state == StateProxy {
+		s.flush(conn, fd)
+		return
+	}
+	if conn.state == StateConnecting && conn.isAttempt(fd) {
+		s.attemptDone(conn, fd)
+	}
+}
 
-					s.mu.Lock()
-					s.connections[conn.rfd] = conn
-					s.connections[conn.fd] = conn
-					s.mu.Unlock()
+// connected reports success for the upstream socket conn.rfd and switches
+// the session to proxying.
+func (s *Server) connected(conn *Conn) {
+	var ip net.IP
+	var port uint16
+	if sa, err := unix.Getsockname(conn.rfd); err == nil {
+		ip, port = sockaddrToIP(sa)
+	}
+	s.replySucceeded(conn, ip, port)
+	s.metrics.connects.Add(1)
+	s.metrics.connectLatency.observe(time.Since(conn.dialed))
+	s.selecter.Modify(conn.rfd, EventRead)
+	s.connections[conn.rfd] = conn
+
+	fmt.Printf("Connected to host %s:%d\n", conn.host, conn.port)
+	s.startProxy(conn)
+}
 
-					fmt.Printf("Connected to host %s:%d\n", conn.host, conn.port)
-				}
-			}
+// startProxy switches to StateProxy and hands the upstream whatever the
+// client sent after its request, including an early FIN.
+func (s *Server) startProxy(conn *Conn) {
+	s.setState(conn, StateProxy)
+	s.limiter.acquire(conn)
+	if s.splice {
+		s.startSplice(conn)
+	}
+	if len(conn.in) > 0 {
+		data := conn.in
+		conn.in = nil
+		s.account(conn, &conn.up, len(data))
+		if err := s.send(conn.rfd, &conn.up, data); err != nil {
+			s.closeWith(conn, "write error: "+err.Error())
+			return
 		}
 	}
+	s.finish(conn, conn.rfd, &conn.up)
+	if conn.fd > 0 && conn.up.paused {
+		conn.up.paused = false
+		s.relayRead(conn, conn.fd)
+	}
 }
 
+// Close releases the loop of s and the access log and metrics server its
+// workers share with it.
 func (s *Server) Close() {
-	if s.listenFD > 0 {
-		unix.Close(s.listenFD)
+	s.closeLoop()
+	if s.accessLog != nil {
+		s.accessLog.Close()
 	}
-	if s.selecter > 0 {
-		unix.Close(s.selecter)
+	s.metrics.Close()
+}
+
+// closeLoop releases what belongs to this event loop alone.
+func (s *Server) closeLoop() {
+	s.closeListeners()
+	if s.resolver != nil {
+		s.resolver.Close()
+	}
+	if s.selecter != nil {
+		s.selecter.Close()
 	}
-	s.mu.Lock()
+	s.closeAdminSocket()
+	s.closeSignals()
 	for _, c := range s.connections {
 		if c != nil {
 			if c.fd > 0 {
@@ -324,213 +585,187 @@ func (s *Server) Close() {
 			if c.rfd > 0 {
 				unix.Close(c.rfd)
 			}
+			if c.ufd > 0 {
+				unix.Close(c.ufd)
+			}
+			if c.lfd > 0 {
+				unix.Close(c.lfd)
+			}
 		}
 	}
-	s.mu.Unlock()
 }
 
 func (s *Server) answerHello(answer byte, fd int, ip net.IP, port uint16, domain string) {
 	var buf bytes.Buffer
 	buf.Write([]byte{byte(FIVE), answer, ZERO})
-	buf.WriteByte(byte(ONE))
-	buf.Write([]byte{0, 0, 0, 0})
-	binary.Write(&buf, binary.BigEndian, uint16(0))
+	writeAddress(&buf, ip, port, domain)
 	_, _ = unix.Write(fd, buf.Bytes())
 }
 
-func (s *Server) processRequest(conn *Conn, data []byte) {
-	if len(data) == 0 || len(data) < MIN_LEN_REQUEST {
-		fmt.Println("len client message = 0")
-		return
+func (s *Server) processRequest(conn *Conn, data []byte) (int, error) {
+	if conn.proto == ProtoSOCKS4 {
+		return s.processSocks4Request(conn, data)
+	}
+	if len(data) < 4 {
+		return 0, errIncomplete
 	}
 
 	if data[0] != FIVE {
-		fmt.Println("Version SOCKS != 5")
-		return
+		return 0, newSocksError(REP_GENERAL_FAILURE, "Version SOCKS != 5")
 	}
 
-	if data[1] != ONE {
-		fmt.Println("Command != 1 (CONNECT TCP/IP)")
-		return
+	if data[1] != CMD_CONNECT && data[1] != CMD_BIND && data[1] != CMD_UDP_ASSOCIATE {
+		return 0, newSocksError(REP_COMMAND_NOT_SUPPORTED, "Command != 1 (CONNECT), 2 (BIND) or 3 (UDP ASSOCIATE)")
 	}
+	conn.cmd = data[1]
 
 	if data[2] != 0 {
-		fmt.Println("Reserved != 0")
-		return
+		return 0, newSocksError(REP_GENERAL_FAILURE, "Reserved != 0")
 	}
 
-	if data[3] != ONE && data[3] != THREE {
-		fmt.Println("Address type != 1 (IPV4) or 3 (DOMAIN NAME)")
-		return
+	if data[3] != ATYP_IPV4 && data[3] != ATYP_DOMAIN && data[3] != ATYP_IPV6 {
+		return 0, newSocksError(REP_ADDRESS_NOT_SUPPORTED, "Address type != 1 (IPV4), 3 (DOMAIN NAME) or 4 (IPV6)")
 	}
 
-	if data[3] == ONE {
-		if len(data) < MIN_LEN_REQ_DOMAIN {
-			fmt.Println("invalid IPv4 request length")
-			return
-		}
-		ip := net.IP(data[START_BYTE_IP:FINISH_BYTE_IP])
-		port := binary.BigEndian.Uint16(data[START_BYTE_PORT:FINISH_BYTE_PORT])
-		conn.host = ip.String()
-		conn.port = port
-		fmt.Printf("IP: %s\n", ip.String())
-		fmt.Printf("Port: %v\n", port)
-	}
-
-	if data[3] == THREE {
-		domainLen := int(data[INDEX_LEN_DOMAIN])
-		if MIN_LEN_REQUEST + domainLen > len(data) {
-			fmt.Println("invalid domain request length")
-			return
-		}
-		domain := string(data[START_DOMAIN_BYTE : START_DOMAIN_BYTE + domainLen])
-		port := binary.BigEndian.Uint16(data[START_DOMAIN_BYTE + domainLen : START_DOMAIN_BYTE + domainLen + PORT_LEN])
-		conn.domain = domain
-		conn.host = domain 
-		conn.port = port
-		fmt.Printf("Domain: %s\n", domain)
-		fmt.Printf("Port: %v\n", port)
+	addr, n, err := parseAddress(data[3:])
+	if err == errIncomplete {
+		return 0, err
+	}
+	if err != nil {
+		return 0, newSocksError(REP_GENERAL_FAILURE, "%v", err)
 	}
+	conn.domain = addr.domain
+	conn.host = addr.host()
+	conn.port = addr.port
+	if addr.domain != "" {
+		fmt.Printf("Domain: %s\n", addr.domain)
+	} else {
+		fmt.Printf("IP: %s\n", addr.ip.String())
+	}
+	fmt.Printf("Port: %v\n", addr.port)
+	return 3 + n, nil
 }
 
-func (s *Server) processHello(fd int, data []byte) {
-	if len(data) == 0 {
-		fmt.Println("len client message = 0")
-		return
+func (s *Server) processHello(conn *Conn, data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, errIncomplete
 	}
-	if data[0] != FIVE {
-		fmt.Println("Version SOCKS != 5")
-		return
+	switch {
+	case data[0] == FOUR:
+		// nothing consumed, SOCKS4 starts with the request
+		conn.proto = ProtoSOCKS4
+		s.moveState(conn, StateRequest)
+		return 0, nil
+	case isHTTPMethod(data[0]):
+		// nothing consumed, the request line is parsed in the next state
+		conn.proto = ProtoHTTP
+		s.moveState(conn, StateHTTPRequest)
+		return 0, nil
+	case data[0] != FIVE:
+		return 0, errors.New("Version SOCKS != 5")
 	}
-	if int(data[1]) < 1 {
-		fmt.Println("No auth methods")
-		return
+	if len(data) < 2 {
+		return 0, errIncomplete
+	}
+	nmethods := int(data[1])
+	if nmethods < MIN_COUNT_AUTH {
+		return 0, errors.New("No auth methods")
+	}
+	if len(data) < 2+nmethods {
+		return 0, errIncomplete
 	}
 
+	method := s.selectMethod(data[2 : 2+nmethods])
 	var buf bytes.Buffer
-	buf.Write([]byte{byte(FIVE), byte(ZERO)})
-	_, _ = unix.Write(fd, buf.Bytes())
+	buf.Write([]byte{byte(FIVE), method})
+	_, _ = unix.Write(conn.fd, buf.Bytes())
+
+	switch method {
+	case METHOD_NO_ACCEPTABLE:
+		s.metrics.rejected.Add(1)
+		return 0, errors.New("no acceptable auth method offered")
+	case METHOD_USER_PASS:
+		s.setState(conn, StateAuth)
+	default:
+		s.setState(conn, StateRequest)
+	}
+	return 2 + nmethods, nil
 }
 
 
 func (s *Server) queryDNS(conn *Conn) {
-	s.mu.Lock()
 	if conn.resolving {
-		s.mu.Unlock()
 		return
 	}
 	conn.resolving = true
-	s.mu.Unlock()
 
-	go func() {
-		addrs, err := net.LookupIP(conn.host)
-		s.mu.Lock()
-
-		current, ok := s.connections[conn.fd]
-		if !ok || current != conn {
+	host, _ := conn.target()
+	s.resolver.lookup(host, func(addrs []net.IP, err error) {
+		if conn.fd == 0 {
+			// the session was closed while resolving
 			return
 		}
-
 		conn.resolving = false
 
-		if err != nil || len(addrs) == 0 {
-			fmt.Printf("Failed to resolve host %s: %v\n", conn.host, err)
-			if conn.rfd > 0 {
-				unix.Close(conn.rfd)
-				delete(s.connections, conn.rfd)
-				conn.rfd = 0
-			}
-			s.closeConn(conn)
+		if err != nil {
+			fmt.Printf("Failed to resolve host %s: %v\n", host, err)
+			s.replyError(conn, err)
 			return
 		}
 
-		ip := addrs[0]
-		conn.host = ip.String()
-
-		s.mu.Unlock()
-		s.connectToHost(conn)
-	}()
+		if err := s.startRace(conn, interleave(addrs)); err != nil {
+			s.replyError(conn, err)
+		}
+	})
 }
 
-func (s *Server) connectToHost(conn *Conn) {
-	s.mu.Lock()
-	if conn.rfd > 0 || conn.state == StateConnecting || conn.state == StateProxy {
-		s.mu.Unlock()
-		return
-	}
-	s.mu.Unlock()
-
-	rfd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
-	if err != nil {
-		return
+func (s *Server) connectToHost(conn *Conn) error {
+	if conn.rfd > 0 || conn.resolving || conn.attempts != nil {
+		return nil
 	}
-	_ = unix.SetNonblock(rfd, true)
 
 	ip := net.ParseIP(conn.host)
-	if ip == nil {
-		s.queryDNS(conn)
-		unix.Close(rfd)
-		return
-	}
-
-	ipv4 := ip.To4()
-	if ipv4 == nil {
-		fmt.Printf("Not an IPv4 address: %s\n", conn.host)
-		unix.Close(rfd)
-		return
-	}
-
-	addr := &unix.SockaddrInet4{Port: int(conn.port)}
-	copy(addr.Addr[:], ipv4)
-	err = unix.Connect(rfd, addr)
-	if err != nil && err != unix.EINPROGRESS {
-		unix.Close(rfd)
-		return
+	if err := s.checkDestination(conn, ip); err != nil {
+		return err
 	}
-
-	change := unix.Kevent_t{
-		Ident:  uint64(rfd),
-		Filter: unix.EVFILT_WRITE,
-		Flags:  unix.EV_ADD | unix.EV_CLEAR,
+	conn.via = s.upstreamFor(conn, ip)
+	conn.dialed = time.Now()
+	host, _ := conn.target()
+	if ip = net.ParseIP(host); ip == nil {
+		s.setState(conn, StateConnecting)
+		s.queryDNS(conn)
+		return nil
 	}
-	unix.Kevent(s.selecter, []unix.Kevent_t{change}, nil, nil)
-
-	s.mu.Lock()
-	conn.rfd = rfd
-	conn.state = StateConnecting
-	s.connections[rfd] = conn
-	s.connections[conn.fd] = conn
-	s.mu.Unlock()
+	return s.startRace(conn, []net.IP{ip})
 }
 
 func (s *Server) closeConn(conn *Conn) {
 	if conn == nil {
 		return
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
 	if conn.fd > 0 {
-		unix.Close(conn.fd)
-		delete(s.connections, conn.fd)
-	}
-	if conn.rfd > 0 {
-		unix.Close(conn.rfd)
-		delete(s.connections, conn.rfd)
-	}
-}
-
-func writeFull(fd int, buf []byte) error {
-	off := 0
-	for off < len(buf) {
-		n, err := unix.Write(fd, buf[off:])
-		if n > 0 {
-			off += n
-			continue
+		if conn.reason == "" {
+			conn.reason = "closed"
 		}
-		if err != nil {
-			return err
+		s.logAccess(conn)
+		s.metrics.states[conn.state].Add(-1)
+	}
+	if conn.attempts != nil {
+		s.stopRace(conn, -1)
+	}
+	s.timers.stop(conn.deadline)
+	conn.deadline = nil
+	s.timers.stop(conn.up.throttle)
+	s.timers.stop(conn.down.throttle)
+	conn.up.throttle, conn.down.throttle = nil, nil
+	s.limiter.release(conn)
+	closePipes(conn)
+	for _, fd := range []*int{&conn.fd, &conn.rfd, &conn.ufd, &conn.lfd} {
+		if *fd > 0 {
+			s.selecter.Remove(*fd)
+			unix.Close(*fd)
+			delete(s.connections, *fd)
+			*fd = 0
 		}
-		return fmt.Errorf("write returned 0")
 	}
-	return nil
 }
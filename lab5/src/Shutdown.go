@@ -0,0 +1,87 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+var errShuttingDown = errors.New("server shutting down")
+
+func (s *Server) SetDrainTimeout(d time.Duration) {
+	s.drain = d
+}
+
+// shutdown runs on SIGTERM or SIGINT: listeners are closed, sessions still
+// negotiating are refused and proxied sessions may finish until the drain
+// deadline. A second signal closes everything at once.
+func (s *Server) shutdown() {
+	if s.draining {
+		fmt.Println("Second shutdown signal, closing all sessions")
+		s.closeAll()
+		return
+	}
+	s.draining = true
+	for _, fd := range s.listeners {
+		s.selecter.Remove(fd)
+		unix.Close(fd)
+	}
+	s.listeners = nil
+
+	for _, conn := range s.connections {
+		if conn.fd > 0 && conn.state != StateProxy {
+			s.refuse(conn)
+		}
+	}
+	fmt.Printf("Shutting down, draining %d sessions for up to %s\n", s.sessions(), s.drain)
+	s.timers.after(s.drain, func() {
+		if n := s.sessions(); n > 0 {
+			fmt.Printf("Drain deadline passed, closing %d sessions\n", n)
+		}
+		s.closeAll()
+	})
+}
+
+// refuse answers a session that has not reached StateProxy in the message
+// its client is waiting for, then closes it.
+func (s *Server) refuse(conn *Conn) {
+	switch conn.state {
+	case StateHello:
+		if len(conn.in) > 0 {
+			_, _ = unix.Write(conn.fd, []byte{byte(FIVE), METHOD_NO_ACCEPTABLE})
+		}
+		s.closeWith(conn, errShuttingDown.Error())
+	case StateAuth:
+		_, _ = unix.Write(conn.fd, []byte{AUTH_VERSION, AUTH_FAILURE})
+		s.closeWith(conn, errShuttingDown.Error())
+	case StateAssociate:
+		s.closeWith(conn, errShuttingDown.Error())
+	default:
+		s.replyError(conn, errShuttingDown)
+	}
+}
+
+// sessions counts the live sessions; connections holds one entry per fd.
+func (s *Server) sessions() int {
+	seen := make(map[*Conn]bool)
+	for _, conn := range s.connections {
+		seen[conn] = true
+	}
+	return len(seen)
+}
+
+func (s *Server) closeAll() {
+	for _, conn := range s.connections {
+		s.closeWith(conn, errShuttingDown.Error())
+	}
+}
+
+// drained tells WaitEvents to return once shutdown has closed the last
+// session.
+func (s *Server) drained() bool {
+	return s.draining && len(s.connections) == 0
+}
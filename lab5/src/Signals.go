@@ -0,0 +1,83 @@
+package src
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// initSignals turns signals into readable bytes on a pipe watched by the
+// poller, so they are handled inside the event loop like any other fd. A
+// zero byte wakes the loop for work posted to its inbox.
+func (s *Server) initSignals() error {
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		return err
+	}
+	for _, fd := range p {
+		unix.CloseOnExec(fd)
+		if err := unix.SetNonblock(fd, true); err != nil {
+			unix.Close(p[0])
+			unix.Close(p[1])
+			return err
+		}
+	}
+	if err := s.selecter.Add(p[0], EventRead); err != nil {
+		unix.Close(p[0])
+		unix.Close(p[1])
+		return err
+	}
+	s.signalFD = p[0]
+	s.wakeFD = p[1]
+
+	s.signals = make(chan os.Signal, 8)
+	s.signalsDone = make(chan struct{})
+	signal.Notify(s.signals, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	go func(ch chan os.Signal) {
+		defer close(s.signalsDone)
+		for sig := range ch {
+			_, _ = unix.Write(p[1], []byte{byte(sig.(syscall.Signal))})
+		}
+	}(s.signals)
+	return nil
+}
+
+// closeSignals stops the signal delivery and waits for the forwarding
+// goroutine before the pipe is closed, so it never writes to a reused fd.
+func (s *Server) closeSignals() {
+	if s.signals != nil {
+		signal.Stop(s.signals)
+		close(s.signals)
+		<-s.signalsDone
+		s.signals = nil
+	}
+	if s.signalFD > 0 {
+		unix.Close(s.signalFD)
+		unix.Close(s.wakeFD)
+		s.signalFD, s.wakeFD = 0, 0
+	}
+}
+
+func (s *Server) handleSignals() {
+	buf := make([]byte, 16)
+	for {
+		n, err := unix.Read(s.signalFD, buf)
+		if n <= 0 || err != nil {
+			return
+		}
+		for _, b := range buf[:n] {
+			switch syscall.Signal(b) {
+			case 0:
+				s.runInbox()
+			case syscall.SIGUSR1:
+				s.resolver.cache.dump(os.Stdout)
+			case syscall.SIGHUP:
+				s.reloadRules()
+			case syscall.SIGTERM, syscall.SIGINT:
+				s.shutdown()
+			}
+		}
+	}
+}
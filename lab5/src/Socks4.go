@@ -0,0 +1,103 @@
+package src
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	SOCKS4_REPLY_VERSION = 0x00
+	SOCKS4_GRANTED       = 0x5A
+	SOCKS4_REJECTED      = 0x5B
+	SOCKS4_BAD_USERID    = 0x5D
+)
+
+// errSocks4UserID refuses a SOCKS4 request while credentials are loaded:
+// its user id cannot be checked against them.
+var errSocks4UserID = newSocksError(REP_NOT_ALLOWED, "user id not accepted")
+
+// SOCKS4 request: VN CD DSTPORT(2) DSTIP(4) USERID NUL, followed by the
+// host name and another NUL when DSTIP is 0.0.0.x (SOCKS4a).
+const socks4HeaderLen = 8
+
+// processSocks4Request parses a SOCKS4 or SOCKS4a CONNECT/BIND request.
+// The request carries the only message of the protocol, so it also
+// stands in for the hello.
+func (s *Server) processSocks4Request(conn *Conn, data []byte) (int, error) {
+	if len(data) < socks4HeaderLen {
+		return 0, errIncomplete
+	}
+	if data[1] != CMD_CONNECT && data[1] != CMD_BIND {
+		return 0, newSocksError(REP_COMMAND_NOT_SUPPORTED, "SOCKS4 command != 1 (CONNECT) or 2 (BIND)")
+	}
+	conn.cmd = data[1]
+	port := binary.BigEndian.Uint16(data[2:4])
+	ip := net.IP(append([]byte(nil), data[4:8]...))
+
+	n := socks4HeaderLen
+	end := bytes.IndexByte(data[n:], 0)
+	if end < 0 {
+		return 0, errIncomplete
+	}
+	userID := string(data[n : n+end])
+	n += end + 1
+
+	domain := ""
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		end = bytes.IndexByte(data[n:], 0)
+		if end < 0 {
+			return 0, errIncomplete
+		}
+		domain = string(data[n : n+end])
+		n += end + 1
+		if domain == "" || len(domain) > 255 {
+			return 0, newSocksError(REP_GENERAL_FAILURE, "invalid SOCKS4a host name")
+		}
+	}
+
+	if s.users != nil {
+		return 0, fmt.Errorf("%w: SOCKS4 cannot authenticate user %q", errSocks4UserID, userID)
+	}
+
+	conn.domain = domain
+	conn.host = ip.String()
+	if domain != "" {
+		conn.host = domain
+		fmt.Printf("Domain: %s\n", domain)
+	} else {
+		fmt.Printf("IP: %s\n", conn.host)
+	}
+	fmt.Printf("Port: %v\n", port)
+	if userID != "" {
+		fmt.Printf("SOCKS4 user id: %s\n", userID)
+	}
+	conn.port = port
+	return n, nil
+}
+
+// socks4Code maps a failed request to the SOCKS4 reply code.
+func socks4Code(err error) byte {
+	if errors.Is(err, errSocks4UserID) {
+		return SOCKS4_BAD_USERID
+	}
+	return SOCKS4_REJECTED
+}
+
+// answerSocks4 sends the 8 byte SOCKS4 reply. Addresses that are not IPv4
+// are written as 0.0.0.0, which tells the client to use the proxy's.
+func (s *Server) answerSocks4(answer byte, fd int, ip net.IP, port uint16) {
+	var buf bytes.Buffer
+	buf.Write([]byte{SOCKS4_REPLY_VERSION, answer})
+	binary.Write(&buf, binary.BigEndian, port)
+	if ip4 := ip.To4(); ip4 != nil {
+		buf.Write(ip4)
+	} else {
+		buf.Write([]byte{0, 0, 0, 0})
+	}
+	_, _ = unix.Write(fd, buf.Bytes())
+}
@@ -0,0 +1,107 @@
+package src
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// With splicing on, every direction of a proxied TCP session gets a pipe
+// and bytes move socket -> pipe -> socket inside the kernel. The bytes in
+// the pipe take the place of st.pending; what is still in st.pending when
+// splicing starts was read earlier and goes out first.
+
+func (s *Server) SetSplice(on bool) {
+	s.splice = on
+}
+
+// startSplice gives both directions of conn a pipe. A session whose pipes
+// cannot be created keeps the copying relay.
+func (s *Server) startSplice(conn *Conn) {
+	for _, st := range []*stream{&conn.up, &conn.down} {
+		p, size, err := newPipe(s.highWater())
+		if err != nil {
+			fmt.Printf("Splice disabled for session: %v\n", err)
+			closePipes(conn)
+			return
+		}
+		st.pipe, st.pipeCap = p, size
+	}
+}
+
+func closePipes(conn *Conn) {
+	for _, st := range []*stream{&conn.up, &conn.down} {
+		if st.pipe[0] > 0 {
+			unix.Close(st.pipe[0])
+			unix.Close(st.pipe[1])
+		}
+		st.pipe, st.piped = [2]int{}, 0
+	}
+}
+
+// spliceRead is relayRead for a spliced stream: it fills the pipe from fd
+// and drains it to dst until fd is empty or the pipe is full.
+func (s *Server) spliceRead(conn *Conn, fd, dst int, st *stream) {
+	for {
+		if st.eof || st.throttle != nil {
+			return
+		}
+		if st.piped >= st.pipeCap {
+			st.paused = true
+			return
+		}
+		limit := st.pipeCap - st.piped
+		if len(conn.buckets) > 0 {
+			var wait time.Duration
+			if limit, wait = s.limiter.allowance(conn, limit); limit == 0 {
+				s.throttle(conn, fd, st, wait)
+				return
+			}
+		}
+		n, err := spliceMove(fd, st.pipe[1], limit)
+		if err != nil {
+			if !isAgain(err) {
+				s.closeWith(conn, "splice error: "+err.Error())
+			} else if st.piped > 0 {
+				// a pipe holding many small segments refuses more before
+				// it reaches pipeCap, so read again once it is drained
+				st.paused = true
+			}
+			return
+		}
+		conn.lastActive = time.Now()
+		s.account(conn, st, n)
+		s.limiter.consume(conn, n)
+		if n == 0 {
+			st.eof = true
+			s.finish(conn, dst, st)
+			return
+		}
+		st.piped += n
+		if err := s.drainPipe(dst, st); err != nil {
+			s.closeWith(conn, "splice error: "+err.Error())
+			return
+		}
+	}
+}
+
+// drainPipe moves piped bytes to dst, after anything still pending, and
+// asks for write readiness when dst does not take them all.
+func (s *Server) drainPipe(dst int, st *stream) error {
+	if len(st.pending) > 0 {
+		// write readiness is already requested for the pending bytes
+		return nil
+	}
+	for st.piped > 0 {
+		n, err := spliceMove(st.pipe[0], dst, st.piped)
+		if err != nil {
+			if isAgain(err) {
+				return s.selecter.Modify(dst, EventRead|EventWrite)
+			}
+			return err
+		}
+		st.piped -= n
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package src
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const spliceSupported = true
+
+// newPipe returns a non-blocking pipe of about size bytes and its actual
+// capacity; the kernel caps it at /proc/sys/fs/pipe-max-size.
+func newPipe(size int) ([2]int, int, error) {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return p, 0, err
+	}
+	n, err := unix.FcntlInt(uintptr(p[0]), unix.F_SETPIPE_SZ, size)
+	if err != nil {
+		n, err = unix.FcntlInt(uintptr(p[0]), unix.F_GETPIPE_SZ, 0)
+	}
+	if err != nil {
+		unix.Close(p[0])
+		unix.Close(p[1])
+		return [2]int{}, 0, err
+	}
+	return p, n, nil
+}
+
+// spliceMove moves up to n bytes from in to out without copying them
+// through user space. One of the two must be a pipe.
+func spliceMove(in, out, n int) (int, error) {
+	moved, err := unix.Splice(in, nil, out, nil, n, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+	return int(moved), err
+}
@@ -0,0 +1,125 @@
+//go:build linux
+
+package src
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// payloadSize is what one benchmark op moves through the proxy.
+const payloadSize = 1 << 20
+
+// startProxy runs a single event loop on a free loopback port and returns
+// its address and a function that shuts it down.
+func startProxy(b *testing.B, splice bool) (string, func()) {
+	b.Helper()
+	s := NewServer()
+	s.SetBuffers(countClient, bufsize)
+	s.SetSplice(splice)
+	if err := s.InitSocket([]listenAddr{{ip: net.IPv4(127, 0, 0, 1), port: 0}}); err != nil {
+		b.Fatal(err)
+	}
+	if err := s.InitSelecter(); err != nil {
+		s.Close()
+		b.Fatal(err)
+	}
+	sa, err := unix.Getsockname(s.listeners[0])
+	if err != nil {
+		s.Close()
+		b.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*unix.SockaddrInet4).Port}
+
+	done := make(chan struct{})
+	go func() {
+		s.WaitEvents()
+		close(done)
+	}()
+	return addr.String(), func() {
+		s.post(s.shutdown)
+		<-done
+		s.Close()
+	}
+}
+
+// dialThrough opens a SOCKS5 CONNECT session to dst through the proxy.
+func dialThrough(b *testing.B, proxy string, dst *net.TCPAddr) net.Conn {
+	b.Helper()
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := []byte{FIVE, 1, 0, FIVE, 1, 0, 1}
+	req = append(req, dst.IP.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(dst.Port))
+	if _, err := c.Write(req); err != nil {
+		b.Fatal(err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		b.Fatal(err)
+	}
+	if reply[1] != 0 || reply[3] != 0 {
+		b.Fatalf("proxy refused the session: % x", reply)
+	}
+	return c
+}
+
+// benchmarkRelay pushes b.N payloads from a loopback sink to the client
+// through one proxied session.
+func benchmarkRelay(b *testing.B, splice bool) {
+	proxy, stop := startProxy(b, splice)
+	defer stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	payload := make([]byte, payloadSize)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// wait for the client, so the handshake stays out of the timing
+		if _, err := c.Read(make([]byte, 1)); err != nil {
+			return
+		}
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := dialThrough(b, proxy, ln.Addr().(*net.TCPAddr))
+	defer c.Close()
+	b.SetBytes(payloadSize)
+	b.ResetTimer()
+	if _, err := c.Write([]byte{0}); err != nil {
+		b.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	if n != int64(b.N)*payloadSize {
+		b.Fatalf("relayed %d bytes, want %d", n, int64(b.N)*payloadSize)
+	}
+}
+
+func BenchmarkRelayCopy(b *testing.B) {
+	benchmarkRelay(b, false)
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, true)
+}
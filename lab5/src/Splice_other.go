@@ -0,0 +1,17 @@
+//go:build !linux
+
+package src
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const spliceSupported = false
+
+func newPipe(size int) ([2]int, int, error) {
+	return [2]int{}, 0, unix.ENOSYS
+}
+
+func spliceMove(in, out, n int) (int, error) {
+	return 0, unix.ENOSYS
+}
@@ -0,0 +1,85 @@
+package src
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultConnectTimeout   = 30 * time.Second
+	defaultIdleTimeout      = 5 * time.Minute
+)
+
+// Timeouts bound how long a session may stay in each phase; zero disables
+// the corresponding limit.
+type Timeouts struct {
+	Handshake time.Duration // StateHello, StateAuth, StateRequest
+	Connect   time.Duration // StateConnecting and StateBinding
+	Idle      time.Duration // StateProxy and StateAssociate without traffic
+}
+
+func (s *Server) SetTimeouts(t Timeouts) {
+	s.timeouts = t
+}
+
+func (s *Server) timeoutFor(state State) time.Duration {
+	switch state {
+	case StateHello, StateAuth, StateRequest, StateHTTPRequest:
+		return s.timeouts.Handshake
+	case StateConnecting, StateBinding, StateUpstreamHello, StateUpstreamAuth, StateUpstreamRequest, StateUpstreamHTTP:
+		return s.timeouts.Connect
+	default:
+		return s.timeouts.Idle
+	}
+}
+
+// setState moves conn to state and restarts its deadline for that phase.
+func (s *Server) setState(conn *Conn, state State) {
+	s.moveState(conn, state)
+	conn.lastActive = time.Now()
+	s.armTimeout(conn, s.timeoutFor(state))
+}
+
+// moveState changes the state of conn but keeps its deadline, for states
+// that belong to the phase conn is already in.
+func (s *Server) moveState(conn *Conn, state State) {
+	if conn.fd > 0 {
+		s.metrics.move(conn.state, state)
+	}
+	conn.state = state
+}
+
+func (s *Server) armTimeout(conn *Conn, d time.Duration) {
+	s.timers.stop(conn.deadline)
+	conn.deadline = nil
+	if d <= 0 {
+		return
+	}
+	conn.deadline = s.timers.after(d, func() {
+		conn.deadline = nil
+		s.expireConn(conn)
+	})
+}
+
+// expireConn closes a session whose phase deadline passed. Idle sessions
+// are only closed when there was no traffic for the whole idle period.
+func (s *Server) expireConn(conn *Conn) {
+	if conn.fd == 0 {
+		return
+	}
+	switch conn.state {
+	case StateProxy, StateAssociate:
+		if idle := time.Since(conn.lastActive); idle < s.timeouts.Idle {
+			s.armTimeout(conn, s.timeouts.Idle-idle)
+			return
+		}
+		fmt.Printf("Session %s:%d idle for %s, closing\n", conn.host, conn.port, s.timeouts.Idle)
+		s.closeWith(conn, "idle timeout")
+	case StateConnecting, StateBinding, StateUpstreamHello, StateUpstreamAuth, StateUpstreamRequest, StateUpstreamHTTP:
+		s.replyError(conn, newSocksError(REP_TTL_EXPIRED, "connect timed out after %s", s.timeouts.Connect))
+	default:
+		fmt.Printf("Handshake timed out after %s, closing\n", s.timeouts.Handshake)
+		s.closeWith(conn, "handshake timeout")
+	}
+}
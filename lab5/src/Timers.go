@@ -0,0 +1,121 @@
+package src
+
+import (
+	"time"
+)
+
+const (
+	wheelTick  = 10 * time.Millisecond
+	wheelSlots = 512
+)
+
+type timer struct {
+	slot   int
+	rounds int
+	fn     func()
+}
+
+// timerWheel is a hashed timing wheel advanced by the event loop: the poller
+// sleeps until the next occupied slot and advance fires whatever is due.
+type timerWheel struct {
+	slots   [wheelSlots]map[*timer]struct{}
+	current int
+	last    time.Time
+	count   int
+}
+
+func newTimerWheel() *timerWheel {
+	w := &timerWheel{last: time.Now()}
+	for i := range w.slots {
+		w.slots[i] = make(map[*timer]struct{})
+	}
+	return w
+}
+
+// after schedules fn to run from the event loop once d has passed.
+func (w *timerWheel) after(d time.Duration, fn func()) *timer {
+	if w.count == 0 {
+		// nothing to catch up on after an idle period
+		w.last = time.Now()
+	}
+	ticks := int((d + wheelTick - 1) / wheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t := &timer{
+		slot:   (w.current + ticks) % wheelSlots,
+		rounds: (ticks - 1) / wheelSlots,
+		fn:     fn,
+	}
+	w.slots[t.slot][t] = struct{}{}
+	w.count++
+	return t
+}
+
+// stop cancels t; stopping a fired or nil timer is a no-op.
+func (w *timerWheel) stop(t *timer) {
+	if t == nil {
+		return
+	}
+	if _, ok := w.slots[t.slot][t]; ok {
+		delete(w.slots[t.slot], t)
+		w.count--
+	}
+}
+
+// nextTimeout returns milliseconds until the next occupied slot, or -1.
+func (w *timerWheel) nextTimeout() int {
+	if w.count == 0 {
+		return -1
+	}
+	for k := 1; k <= wheelSlots; k++ {
+		if len(w.slots[(w.current+k)%wheelSlots]) == 0 {
+			continue
+		}
+		wait := time.Until(w.last.Add(time.Duration(k) * wheelTick))
+		if wait <= 0 {
+			return 0
+		}
+		return int((wait + time.Millisecond - 1) / time.Millisecond)
+	}
+	return -1
+}
+
+// advance moves the wheel up to now and runs the expired timers.
+func (w *timerWheel) advance() {
+	now := time.Now()
+	for !now.Before(w.last.Add(wheelTick)) {
+		w.last = w.last.Add(wheelTick)
+		w.current = (w.current + 1) % wheelSlots
+		if w.count == 0 {
+			w.last = now
+			return
+		}
+		var due []*timer
+		slot := w.slots[w.current]
+		for t := range slot {
+			if t.rounds > 0 {
+				t.rounds--
+				continue
+			}
+			delete(slot, t)
+			w.count--
+			due = append(due, t)
+		}
+		// run after the scan so timers scheduled by fn never land in it
+		for _, t := range due {
+			t.fn()
+		}
+	}
+}
+
+// minTimeout combines two poller timeouts where -1 means infinite.
+func minTimeout(a, b int) int {
+	if a < 0 {
+		return b
+	}
+	if b < 0 || a < b {
+		return a
+	}
+	return b
+}
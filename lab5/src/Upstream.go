@@ -0,0 +1,327 @@
+package src
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	UPSTREAM_SOCKS5 = "socks5"
+	UPSTREAM_HTTP   = "http"
+)
+
+// maxUpstreamReply bounds the handshake answer of an upstream proxy; HTTP
+// proxies may add a few headers to their response.
+const maxUpstreamReply = 8192
+
+// upstream is a proxy that sessions matching a "via" rule are chained
+// through instead of connecting to the destination directly.
+type upstream struct {
+	scheme string
+	host   string
+	port   uint16
+	user   string
+	pass   string
+}
+
+// parseUpstream accepts socks5://[user:pass@]host:port and
+// http://[user:pass@]host:port.
+func parseUpstream(s string) (*upstream, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != UPSTREAM_SOCKS5 && u.Scheme != UPSTREAM_HTTP {
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil || port == 0 || u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream %q needs host:port", s)
+	}
+	up := &upstream{scheme: u.Scheme, host: u.Hostname(), port: uint16(port)}
+	if u.User != nil {
+		up.user = u.User.Username()
+		up.pass, _ = u.User.Password()
+		if len(up.user) > 255 || len(up.pass) > 255 {
+			return nil, errors.New("upstream credentials too long")
+		}
+	}
+	return up, nil
+}
+
+func (u *upstream) String() string {
+	return u.scheme + "://" + net.JoinHostPort(u.host, strconv.Itoa(int(u.port)))
+}
+
+// upstreamFor returns the proxy the rules route conn through, if any. Rules
+// are matched before resolution, so a domain request is only chained by a
+// rule that decides it by name.
+func (s *Server) upstreamFor(conn *Conn, dst net.IP) *upstream {
+	if s.rules == nil {
+		return nil
+	}
+	client, _ := sockaddrToIP(conn.caddr)
+	r, decided := s.rules.match(client, conn.domain, dst, conn.port)
+	if !decided || r == nil || !r.allow {
+		return nil
+	}
+	return r.via
+}
+
+// target is what the session dials: the destination itself or the
+// upstream proxy in front of it.
+func (c *Conn) target() (string, uint16) {
+	if c.via != nil {
+		return c.via.host, c.via.port
+	}
+	return c.host, c.port
+}
+
+func (c *Conn) upstreamPhase() bool {
+	switch c.state {
+	case StateUpstreamHello, StateUpstreamAuth, StateUpstreamRequest, StateUpstreamHTTP:
+		return true
+	}
+	return false
+}
+
+// destination is the host:port the upstream proxy is asked to connect to.
+func (c *Conn) destination() string {
+	host := c.domain
+	if host == "" {
+		host = c.host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(c.port)))
+}
+
+// startUpstream begins the handshake with the proxy connected on conn.rfd.
+// The sub-states share the connect deadline armed for StateConnecting.
+func (s *Server) startUpstream(conn *Conn) {
+	if err := s.selecter.Modify(conn.rfd, EventRead); err != nil {
+		s.replyError(conn, err)
+		return
+	}
+	fmt.Printf("Connected to upstream %s for %s\n", conn.via, conn.destination())
+
+	var msg []byte
+	if conn.via.scheme == UPSTREAM_HTTP {
+		s.moveState(conn, StateUpstreamHTTP)
+		msg = conn.httpConnect()
+	} else if conn.via.user != "" {
+		s.moveState(conn, StateUpstreamHello)
+		msg = []byte{byte(FIVE), 2, METHOD_NO_AUTH, METHOD_USER_PASS}
+	} else {
+		s.moveState(conn, StateUpstreamHello)
+		msg = []byte{byte(FIVE), 1, METHOD_NO_AUTH}
+	}
+	if err := s.writeUpstream(conn, msg); err != nil {
+		s.replyError(conn, err)
+	}
+}
+
+// writeUpstream sends a handshake message. The socket has just connected
+// and the messages are small, so a short write is treated as a failure.
+func (s *Server) writeUpstream(conn *Conn, msg []byte) error {
+	n, err := unix.Write(conn.rfd, msg)
+	if err != nil {
+		return err
+	}
+	if n < len(msg) {
+		return fmt.Errorf("short write to upstream %s", conn.via)
+	}
+	return nil
+}
+
+func (s *Server) readUpstream(conn *Conn) {
+	buf := make([]byte, maxUpstreamReply)
+	for conn.rfd > 0 && conn.upstreamPhase() {
+		n, err := unix.Read(conn.rfd, buf)
+		if err != nil {
+			if !isAgain(err) {
+				s.replyError(conn, err)
+			}
+			return
+		}
+		if n == 0 {
+			s.replyError(conn, fmt.Errorf("upstream %s closed during handshake", conn.via))
+			return
+		}
+		conn.reply = append(conn.reply, buf[:n]...)
+		if err := s.handleUpstream(conn); err != nil {
+			s.replyError(conn, err)
+			return
+		}
+	}
+}
+
+// handleUpstream consumes complete handshake answers from conn.reply, the
+// same way handleRequest does for the client side.
+func (s *Server) handleUpstream(conn *Conn) error {
+	for conn.fd > 0 && len(conn.reply) > 0 {
+		var n int
+		var err error
+		state := conn.state
+		switch state {
+		case StateUpstreamHello:
+			n, err = s.upstreamHello(conn, conn.reply)
+		case StateUpstreamAuth:
+			n, err = s.upstreamAuth(conn, conn.reply)
+		case StateUpstreamRequest:
+			n, err = upstreamReply(conn, conn.reply)
+		case StateUpstreamHTTP:
+			n, err = httpReply(conn, conn.reply)
+		default:
+			return nil
+		}
+		if err == errIncomplete {
+			if len(conn.reply) <= maxUpstreamReply {
+				return nil
+			}
+			err = fmt.Errorf("upstream %s answer too long", conn.via)
+		}
+		if err != nil {
+			return err
+		}
+		conn.reply = conn.reply[n:]
+
+		if state == StateUpstreamRequest || state == StateUpstreamHTTP {
+			s.upstreamReady(conn)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *Server) upstreamHello(conn *Conn, data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, errIncomplete
+	}
+	if data[0] != FIVE {
+		return 0, fmt.Errorf("upstream %s is not a SOCKS5 proxy", conn.via)
+	}
+	switch {
+	case data[1] == METHOD_NO_AUTH:
+		return 2, s.upstreamRequest(conn)
+	case data[1] == METHOD_USER_PASS && conn.via.user != "":
+		var buf bytes.Buffer
+		buf.WriteByte(AUTH_VERSION)
+		buf.WriteByte(byte(len(conn.via.user)))
+		buf.WriteString(conn.via.user)
+		buf.WriteByte(byte(len(conn.via.pass)))
+		buf.WriteString(conn.via.pass)
+		s.moveState(conn, StateUpstreamAuth)
+		return 2, s.writeUpstream(conn, buf.Bytes())
+	}
+	return 0, fmt.Errorf("upstream %s accepts none of our auth methods", conn.via)
+}
+
+func (s *Server) upstreamAuth(conn *Conn, data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, errIncomplete
+	}
+	if data[1] != AUTH_SUCCESS {
+		return 0, fmt.Errorf("upstream %s rejected our credentials", conn.via)
+	}
+	return 2, s.upstreamRequest(conn)
+}
+
+func (s *Server) upstreamRequest(conn *Conn) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{byte(FIVE), CMD_CONNECT, ZERO})
+	writeAddress(&buf, net.ParseIP(conn.host), conn.port, conn.domain)
+	s.moveState(conn, StateUpstreamRequest)
+	return s.writeUpstream(conn, buf.Bytes())
+}
+
+// upstreamReply checks the CONNECT reply; a failure is passed on to the
+// client with the upstream's reply code.
+func upstreamReply(conn *Conn, data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, errIncomplete
+	}
+	if data[0] != FIVE {
+		return 0, fmt.Errorf("upstream %s sent an invalid reply", conn.via)
+	}
+	_, n, err := parseAddress(data[3:])
+	if err != nil {
+		return 0, err
+	}
+	if rep := data[1]; rep != REP_SUCCEEDED {
+		return 0, newSocksError(rep, "upstream %s failed to connect to %s (reply 0x%02x)", conn.via, conn.destination(), rep)
+	}
+	return 3 + n, nil
+}
+
+func (c *Conn) httpConnect() []byte {
+	var buf bytes.Buffer
+	dst := c.destination()
+	fmt.Fprintf(&buf, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", dst, dst)
+	if c.via.user != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(c.via.user + ":" + c.via.pass))
+		fmt.Fprintf(&buf, "Proxy-Authorization: Basic %s\r\n", cred)
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// httpReply waits for the end of the response head and accepts any 2xx.
+func httpReply(conn *Conn, data []byte) (int, error) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return 0, errIncomplete
+	}
+	status, _, _ := strings.Cut(string(data[:end]), "\r\n")
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/1.") {
+		return 0, fmt.Errorf("upstream %s sent an invalid response", conn.via)
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, fmt.Errorf("upstream %s sent an invalid status %q", conn.via, fields[1])
+	}
+	if code/100 != 2 {
+		return 0, newSocksError(httpReplyCode(code), "upstream %s: %s", conn.via, status)
+	}
+	return end + 4, nil
+}
+
+func httpReplyCode(code int) byte {
+	switch code {
+	case 403, 407:
+		return REP_NOT_ALLOWED
+	case 502:
+		return REP_HOST_UNREACHABLE
+	case 504:
+		return REP_TTL_EXPIRED
+	}
+	return REP_GENERAL_FAILURE
+}
+
+// upstreamReady reports success to the client once the upstream proxy
+// tunnels to the destination. Whatever the proxy sent after its answer
+// belongs to the destination's stream.
+func (s *Server) upstreamReady(conn *Conn) {
+	rest := conn.reply
+	conn.reply = nil
+	s.connected(conn)
+	if conn.fd == 0 {
+		return
+	}
+	if len(rest) > 0 {
+		s.account(conn, &conn.down, len(rest))
+		if err := s.send(conn.fd, &conn.down, rest); err != nil {
+			s.closeWith(conn, "write error: "+err.Error())
+			return
+		}
+	}
+	// reads are edge-triggered, pick up what arrived behind the answer
+	s.relayRead(conn, conn.rfd)
+}
@@ -0,0 +1,85 @@
+package src
+
+import (
+	"fmt"
+	"sync"
+)
+
+// worker returns a server with the configuration of s and its own poller,
+// listeners, resolver, timers and connection table. Credentials, the
+// access log and the rate limiter are shared; rules are reloaded by every
+// worker on SIGHUP and DNS answers are cached per worker.
+func (s *Server) worker() *Server {
+	w := NewServer()
+	w.users = s.users
+	w.rules = s.rules
+	w.timeouts = s.timeouts
+	w.accessLog = s.accessLog
+	w.limiter = s.limiter
+	w.metrics = s.metrics
+	w.drain = s.drain
+	w.backlog = s.backlog
+	w.bufferSize = s.bufferSize
+	w.splice = s.splice
+	w.reusePort = true
+	return w
+}
+
+// RunWorkers serves addrs with n independent event loops. Each binds its
+// own listeners with SO_REUSEPORT, the calling goroutine runs the last one.
+// It returns after every loop has drained on shutdown, or with an error if
+// a loop cannot be set up.
+func (s *Server) RunWorkers(n int, addrs []listenAddr) error {
+	// the workers share the access log and metrics of s, which are closed
+	// here once every loop is done
+	defer s.Close()
+	if n <= 1 {
+		if err := s.InitSocket(addrs); err != nil {
+			return err
+		}
+		if err := s.InitSelecter(); err != nil {
+			return err
+		}
+		s.WaitEvents()
+		return nil
+	}
+	workers := make([]*Server, 0, n)
+	for i := 0; i < n; i++ {
+		w := s.worker()
+		if i == n-1 {
+			// the loop of the calling goroutine serves the admin socket
+			w.adminPath = s.adminPath
+		}
+		workers = append(workers, w)
+		if err := w.InitSocket(addrs); err != nil {
+			closeWorkers(workers)
+			return err
+		}
+		if err := w.InitSelecter(); err != nil {
+			closeWorkers(workers)
+			return err
+		}
+	}
+	for _, w := range workers {
+		w.loops = workers
+	}
+	fmt.Printf("Started %d event loops\n", n)
+	var wg sync.WaitGroup
+	for _, w := range workers[:n-1] {
+		wg.Add(1)
+		go func(w *Server) {
+			defer wg.Done()
+			w.WaitEvents()
+		}(w)
+	}
+	workers[n-1].WaitEvents()
+	wg.Wait()
+	closeWorkers(workers)
+	return nil
+}
+
+func closeWorkers(workers []*Server) {
+	for _, w := range workers {
+		w.closeLoop()
+	}
+}